@@ -0,0 +1,240 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ActivityProvider is a source of the live DNS query rate which the noise rate is derived from.
+type ActivityProvider interface {
+	// FetchQPS returns the current live query rate in queries per second.
+	FetchQPS() (float64, error)
+}
+
+// activityConfig sets up the provider of the live query rate used for calculating the sleep period, as chosen by the
+// activityProvider element. By default ("auto"), the pihole is used if enabled, otherwise the activity source (if enabled).
+// A chosen provider which isn't enabled (e.g. the pihole's token is missing) is logged and the random timing is used instead.
+// It returns the rate settings, state, and provider of the block the live query rate is taken from, or nil if the sleep
+// period is not derived from the live query rate.
+func activityConfig(c *Config) *ActivityRate {
+	choice := c.ActivityProvider
+	if choice == "" || choice == "auto" {
+		switch {
+		case c.Pihole.Enabled:
+			if c.ActivitySource.Enabled {
+				log.Println("Pihole enabled; ignoring the activity source")
+			}
+			choice = "pihole"
+		case c.ActivitySource.Enabled:
+			choice = "activitySource"
+		default:
+			choice = "none"
+		}
+	}
+
+	switch choice {
+	case "pihole":
+		if !c.Pihole.Enabled {
+			log.Println("Pihole chosen as the activity provider but not enabled; using random timing")
+			return nil
+		}
+		a := &c.Pihole.ActivityRate
+		a.Provider = &piholeProvider{pihole: &c.Pihole}
+		a.Name = "pihole"
+		a.Window = c.Pihole.ActivityPeriod.Duration()
+		return a
+	case "activitySource":
+		if !c.ActivitySource.Enabled {
+			log.Println("Activity source chosen as the activity provider but not enabled; using random timing")
+			return nil
+		}
+		a := &c.ActivitySource.ActivityRate
+		a.Provider = newWebhookProvider(&c.ActivitySource)
+		a.Name = "activity source"
+		a.Window = c.ActivitySource.Refresh.Duration()
+		return a
+	case "none":
+		log.Println("No activity provider; using random timing")
+	}
+
+	return nil
+}
+
+// activityPihole checks whether the live query rate is taken from the pihole (and so its queries are observed).
+func activityPihole(a *ActivityRate) bool {
+	if a == nil {
+		return false
+	}
+
+	_, ok := a.Provider.(*piholeProvider)
+	return ok
+}
+
+// piholeProvider provides the live query rate from the pihole's query activity over its activity period.
+type piholeProvider struct {
+	pihole *Pihole
+}
+
+// FetchQPS returns the pihole's query rate over the activity period, after filtering out the noise host (if configured).
+func (p *piholeProvider) FetchQPS() (float64, error) {
+	numQueries, err := piholeFetchActivity(p.pihole)
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(numQueries) / p.pihole.ActivityPeriod.Duration().Seconds(), nil
+}
+
+// webhookProvider provides the live query rate from an HTTP endpoint, e.g. a Prometheus query or a custom endpoint.
+type webhookProvider struct {
+	source *ActivitySource
+	client *http.Client
+}
+
+// newWebhookProvider creates a provider for the activity source.
+// If insecure verification is configured, the endpoint's certificate is not verified when using https.
+func newWebhookProvider(a *ActivitySource) *webhookProvider {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if a.Insecure {
+		log.Println("WARNING: TLS certificate verification disabled for the activity source")
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &webhookProvider{
+		source: a,
+		client: &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}
+}
+
+// FetchQPS returns the query rate reported by the activity source's URL.
+// The response body is either the rate itself or, if a field is configured, a JSON document holding the rate in that field.
+func (w *webhookProvider) FetchQPS() (float64, error) {
+	request, err := http.NewRequest(http.MethodGet, w.source.Url, nil)
+	if err != nil {
+		return 0, err
+	}
+	for name, value := range w.source.Headers {
+		request.Header.Set(name, os.ExpandEnv(value))
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Unexpected status from activity source; status '%s'", response.Status)
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if w.source.Field == "" {
+		return strconv.ParseFloat(strings.TrimSpace(string(body)), 64)
+	}
+
+	var doc interface{}
+	err = json.Unmarshal(body, &doc)
+	if err != nil {
+		return 0, err
+	}
+
+	return jsonFieldValue(doc, w.source.Field)
+}
+
+// jsonFieldValue looks up the number in the decoded JSON document at the dot-separated path of the field.
+// Each element of the path is either an object key or an array index, e.g. "data.result.0.value.1" for a Prometheus query.
+// The number may also be given as a string (as Prometheus does for sample values).
+// It returns the number or an error if the path doesn't lead to one.
+func jsonFieldValue(doc interface{}, field string) (float64, error) {
+	value := doc
+	for _, key := range strings.Split(field, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return 0, fmt.Errorf("No element '%s' in field '%s'", key, field)
+			}
+			value = v[i]
+		default:
+			return 0, fmt.Errorf("No element '%s' in field '%s'", key, field)
+		}
+	}
+
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+
+	return 0, fmt.Errorf("Field '%s' is not a number", field)
+}
+
+// activityRefresh fetches the live query rate from the provider and recalculates the sleep period from it.
+// If the fetch fails (or there is no activity), the last good sleep period is kept and the consecutive failures counted;
+// once they exceed the failure grace, calcSleepPeriod falls back to the random timing until a fetch succeeds.
+func activityRefresh(a *ActivityRate, n *Noise) {
+	if a.Timestamp.IsZero() {
+		log.Printf("Initialized %s timestamp", a.Name)
+		a.Timestamp = time.Now()
+	}
+
+	// the realized noise rate is that of the requests sent since the previous refresh (none for the initial one)
+	sent := atomic.LoadInt64(&dnsQueriesSent)
+	var noiseRate float64
+	if elapsed := time.Since(a.Timestamp); elapsed > a.Refresh.Duration() {
+		noiseRate = float64(sent-a.QueriesSent) / elapsed.Seconds()
+	}
+	a.QueriesSent = sent
+	a.Timestamp = time.Now()
+
+	liveRate, err := a.Provider.FetchQPS()
+	if err == nil && liveRate <= 0 {
+		err = fmt.Errorf("No activity available")
+	}
+	if err != nil {
+		a.Failures++
+		if a.Failures == a.FailureGrace+1 {
+			log.Printf("Activity from %s unavailable for %d refreshes; using random timing: %v", a.Name, a.Failures, err)
+		} else if a.Failures <= a.FailureGrace {
+			log.Printf("Activity from %s unavailable; keeping the last sleep period: %v", a.Name, err)
+		}
+		return
+	}
+	if a.Failures > a.FailureGrace {
+		log.Printf("Activity from %s available again", a.Name)
+	}
+	a.Failures = 0
+
+	// any noise not excluded by the filter would otherwise feed back into the rate, so it is subtracted as well
+	if a.SubtractNoise {
+		liveRate = subtractNoise(liveRate, noiseRate, a.Window)
+	}
+
+	metricsDnsPiholeRate(liveRate)
+	if noiseRate > 0 {
+		metricsDnsLiveRatio(noiseRate / liveRate)
+	}
+
+	min, max := noiseProfilePeriods(n)
+	a.SleepPeriod = calcActivityPeriod(liveRate, a.NoisePercentage, min, max)
+}
@@ -0,0 +1,166 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeProvider is an ActivityProvider reporting a fixed live query rate, or an error if failing.
+type fakeProvider struct {
+	qps     float64
+	failing bool
+	fetches int
+}
+
+func (f *fakeProvider) FetchQPS() (float64, error) {
+	f.fetches++
+	if f.failing {
+		return 0, fmt.Errorf("provider unavailable")
+	}
+
+	return f.qps, nil
+}
+
+// activityTestConfig returns a config with a 1s-10s period and no jitter, so the sleep period is that of the activity.
+func activityTestConfig(t *testing.T) *Config {
+	c := newConfig()
+	err := json.Unmarshal([]byte(`{"noise": {"minPeriod": "1s", "maxPeriod": "10s", "jitterPercentage": 0}}`), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// activityTestRate returns the rate state for the provider, refreshed on every sleep period calculation.
+func activityTestRate(p ActivityProvider) *ActivityRate {
+	return &ActivityRate{
+		NoisePercentage: 10,
+		FailureGrace:    2,
+		Provider:        p,
+		Name:            "fake",
+		Window:          10 * time.Second,
+	}
+}
+
+// TestActivityFailureGrace checks that the last good sleep period is kept through failed refreshes until the failure
+// grace is exceeded, that the random timing is used after that, and that the activity is used again once available.
+func TestActivityFailureGrace(t *testing.T) {
+	c := activityTestConfig(t)
+	p := &fakeProvider{qps: 5}
+	a := activityTestRate(p)
+	rng := rand.New(rand.NewSource(1))
+
+	// 10% of 5 queries/s is a query every 2s
+	if period := calcSleepPeriod(c, a, rng); period != 2*time.Second {
+		t.Fatalf("sleep period is %v; want 2s", period)
+	}
+
+	p.failing = true
+	for i := 1; i <= a.FailureGrace; i++ {
+		if period := calcSleepPeriod(c, a, rng); period != 2*time.Second {
+			t.Fatalf("sleep period after %d failures is %v; want the last good period of 2s", i, period)
+		}
+	}
+
+	period := calcSleepPeriod(c, a, rng)
+	if a.Failures != a.FailureGrace+1 {
+		t.Fatalf("failures are %d; want %d", a.Failures, a.FailureGrace+1)
+	}
+	if period == 2*time.Second || period < time.Second || period > 10*time.Second {
+		t.Errorf("sleep period past the failure grace is %v; want a random period within 1s-10s", period)
+	}
+
+	p.failing = false
+	p.qps = 2
+	if period := calcSleepPeriod(c, a, rng); period != 5*time.Second {
+		t.Errorf("sleep period once available again is %v; want 5s", period)
+	}
+	if a.Failures != 0 {
+		t.Errorf("failures are %d once available again; want 0", a.Failures)
+	}
+	if p.fetches != a.FailureGrace+3 {
+		t.Errorf("provider fetched %d times; want %d", p.fetches, a.FailureGrace+3)
+	}
+}
+
+// TestActivityNoActivity checks that a provider reporting no activity is treated as a failed refresh.
+func TestActivityNoActivity(t *testing.T) {
+	c := activityTestConfig(t)
+	a := activityTestRate(&fakeProvider{qps: 0})
+
+	activityRefresh(a, &c.Noise)
+	if a.Failures != 1 || a.SleepPeriod != 0 {
+		t.Errorf("failures are %d and sleep period %v; want 1 and none", a.Failures, a.SleepPeriod)
+	}
+}
+
+// TestActivityClamping checks that the sleep period derived from the activity is kept within the min/max period.
+func TestActivityClamping(t *testing.T) {
+	c := activityTestConfig(t)
+
+	tests := []struct {
+		qps  float64
+		want time.Duration
+	}{
+		{1000, time.Second},
+		{0.001, 10 * time.Second},
+		{4, 2500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		a := activityTestRate(&fakeProvider{qps: test.qps})
+		activityRefresh(a, &c.Noise)
+		if a.SleepPeriod != test.want {
+			t.Errorf("sleep period for %v queries/s is %v; want %v", test.qps, a.SleepPeriod, test.want)
+		}
+	}
+}
+
+// TestActivitySubtractNoise checks that the realized noise rate is removed from the live rate before the sleep period
+// is calculated from it.
+func TestActivitySubtractNoise(t *testing.T) {
+	c := activityTestConfig(t)
+	a := activityTestRate(&fakeProvider{qps: 10})
+	a.SubtractNoise = true
+
+	// 50 noise queries were sent over the last 10s, so half of the live rate of 10 queries/s is the noise
+	sent := atomic.LoadInt64(&dnsQueriesSent)
+	defer atomic.StoreInt64(&dnsQueriesSent, sent)
+	a.QueriesSent = sent
+	atomic.StoreInt64(&dnsQueriesSent, sent+50)
+	a.Timestamp = time.Now().Add(-10 * time.Second)
+
+	activityRefresh(a, &c.Noise)
+	if a.SleepPeriod < 1900*time.Millisecond || a.SleepPeriod > 2000*time.Millisecond {
+		t.Errorf("sleep period is %v; want about 2s from the remaining 5 queries/s", a.SleepPeriod)
+	}
+}
+
+// TestSubtractNoise checks the noise estimate removed from the live rate, which always keeps 1 query per window.
+func TestSubtractNoise(t *testing.T) {
+	tests := []struct {
+		liveRate, noiseRate float64
+		window              time.Duration
+		want                float64
+	}{
+		{10, 4, 10 * time.Second, 6},
+		{10, 0, 10 * time.Second, 10},
+		{10, 10, 10 * time.Second, 0.1},
+		{1, 5, 10 * time.Second, 0.1},
+		{0.05, 1, 10 * time.Second, 0.05},
+	}
+	for _, test := range tests {
+		got := subtractNoise(test.liveRate, test.noiseRate, test.window)
+		if got < test.want-1e-9 || got > test.want+1e-9 {
+			t.Errorf("subtractNoise(%v, %v, %v) is %v; want %v", test.liveRate, test.noiseRate, test.window, got, test.want)
+		}
+	}
+}
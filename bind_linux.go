@@ -0,0 +1,27 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// bindToDevice returns a dialer control function binding the sockets to the named network interface (SO_BINDTODEVICE).
+// Binding to a device typically requires the CAP_NET_RAW capability.
+func bindToDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}, nil
+}
@@ -0,0 +1,18 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToDevice is not supported on platforms without SO_BINDTODEVICE.
+func bindToDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, fmt.Errorf("binding to an interface is not supported on this platform")
+}
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -17,13 +20,25 @@ type Flags struct {
 	ReuseDatabase bool
 	MinPeriod     time.Duration
 	MaxPeriod     time.Duration
+	Seed          int64
+	Once          int
+	Validate      bool
+	Command       string
+	ExportPath    string
+	RefreshLabels string
+	Status        bool
+	Profile       string
 }
 
 /*
 Config contains the configuration information used by the application for customizing its behavior.
-The configuration file defaults to a JSON-encoded file named "dns-noise.json" in the current working directory.
+The configuration file defaults to a JSON-encoded file named "dns-noise.json" in the current working directory, or failing
+that in "/etc/dns-noise/" or "~/.config/dns-noise/" (see configSearchPaths).
 It may be overwritten by supplying an alternative filepath using the '-c' or '--conf' command-line option.
   e.g. dns-noise -c /usr/local/etc/dns-noise.conf
+When reusing the database with the '-r' or '--reusedb' option, the sources with the labels given to the '--refresh-on-start'
+option are still reloaded at startup while the data of the other sources is kept.
+  e.g. dns-noise -r --refresh-on-start source1,source3
 The configuration must be expressed as strict JSON, so unfortunately comments in the configuration file are not
 supported. JSON has an especially unforgiving syntax structure, so careful attention to the brackets, braces, and commas
 is necessary. An example configuration file is included which may be edited/revised as desired.
@@ -45,30 +60,110 @@ Here is an annotated reference for the configuration file format:
     { "ip": "::1", zone: "eth0", "port": 53 }
   ],
 
+  The "duplicateNameservers" element is *optional* and specifies how a nameserver listed more than once (with the same address
+  and port) is handled. The "remove" value keeps only the first entry and logs the others as removed. The "keep" value keeps
+  the duplicates, e.g. to deliberately retry a nameserver on failover. The "fatal" value treats a duplicate as a fatal error.
+  The default value is "remove".
+
+  "duplicateNameservers": "remove",
+
   The "sources" block is *required* and must have at least one entry defining the source and interpretation rules.
   A source provides a list of domains that will be randomly selected for querying the DNS servers in order to generate noise.
-  Each source describes the URL, how to interpret the data, and the refresh policy. All data files must be in CSV form,
-  although the application can independently unzip the file if necessary.
-  *  Each source entry *must* contain a "url" element specifying the URL for the domains data.
+  Each source describes the URL, how to interpret the data, and the refresh policy. All data files must be in CSV, hosts, or replay
+  form, although the application can independently unzip (".zip") or gunzip (".gz") the file if necessary.
+  Sources compressed with xz (".xz") or zstd (".zst") are decompressed with the "xz" or "zstd" command, which must be installed.
+  *  Each source entry *must* contain a "url" element specifying the URL for the domains data, unless it contains a "domains" element.
+  *  A source *may* contain a "headers" element with HTTP headers added to the fetch, e.g. for a private object store or a
+     server requiring authentication. Environment variables in the values (e.g. "Bearer ${LIST_TOKEN}") are expanded so
+     credentials need not be kept in the configuration file. Basic authentication may also be given in the URL itself.
+     The url may also name an object in S3 ("s3://bucket/key") or Google Cloud Storage ("gs://bucket/object"). An S3 object
+     is fetched from the bucket's endpoint in the region of AWS_REGION (or AWS_DEFAULT_REGION, defaulting to "us-east-1")
+     and the request signed with AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN (if set). A GCS object is
+     fetched with GOOGLE_OAUTH_ACCESS_TOKEN as the bearer token (e.g. from "gcloud auth print-access-token"), unless the
+     headers set the authorization. Without credentials in the environment, the object is fetched unauthenticated.
+  *  A source *may* contain a "domains" element with an inline list of domains, which is loaded directly without any fetch.
+     The "url", "format", "column", and "refresh" elements are ignored for such a source.
+  *  A source *may* contain a "format" element indicating how the data file is interpreted. The "csv" format reads the
+     domains from the designated column. The "hosts" format reads /etc/hosts style lines (e.g. "0.0.0.0 ads.example.com")
+     and uses the hostname(s), ignoring the IP address, comments, and blank lines. The "replay" format reads the query names
+     captured from real traffic (e.g. exported from a pcap with "tshark -r capture.pcap -T fields -e frame.time_epoch -e dns.qry.name"),
+     one query per line. Leading timing fields and any trailing fields (e.g. the query type) are ignored, as the queries are
+     sent at the noise cadence in a randomized order. If unspecified, the default value is "csv".
+  *  The "url" element *may* be a "file://" URL for a local file (e.g. "file:///var/lib/dns-noise/queries.txt"), which is
+     read as if it had been downloaded.
   *  A source *may* contain a "column" element indicating which column in the data file contains the list of domains.
      If unspecified, the default value is 0 which will specify the first column.
-  *  A source *may* contain a "label" element to uniquely identify the dataset associated with the source.
-     If unspecified, the entire dataset for all sources will be purged when a refresh is triggered.
+  *  A source *may* contain a "columnName" element naming the column (e.g. "domain") which contains the list of domains instead.
+     The first row of the data file is then read as the header row (and not loaded), and the column with that name is used
+     regardless of its position. It is an error if no column has the name. The "column" element is ignored if it is given.
+  *  A source *may* contain a "parseErrors" element specifying how a malformed CSV record (e.g. a stray quote) is handled.
+     The "skip" value logs and skips the record and continues loading. The "abort" value aborts the load of the source,
+     leaving its existing data (if any) in place. Other sources are loaded regardless. If unspecified, the default value is "abort".
+  *  Each source entry *must* contain a "label" element to uniquely identify the dataset associated with the source.
+     The label determines which data is purged when the source is refreshed, so a missing or duplicated label would let
+     one source's refresh clobber another's data. Both are rejected as a fatal configuration error.
   *  A source *may* contain a "refresh" element specifying the interval for the domains data to be reloaded from the URL.
      If unspecified, the default behavior will be to never refresh. The interval must be parsable by Go's time.ParseDuration().
+     Alternatively, it may be a 5-field cron expression (e.g. "30 5 * * *" for daily at 05:30 local time) to refresh at set
+     times, such as shortly after the provider publishes an updated list.
+  *  A source *may* contain a "maxDomains" element limiting the number of domains loaded from the source. If the source has
+     more domains, a uniform random sample of that many domains is loaded. The default value is 0 which loads all domains.
+  *  A source *may* contain a "sourceWeight" element controlling how often its domains are selected independent of how many
+     domains it has. If any source has a weight, a source is first chosen with a probability proportional to its weight
+     (sources without one have a weight of 1) and then a random domain from that source. Otherwise, domains are selected
+     uniformly across all of the sources, so a large source is selected proportionally more often than a small one.
+  *  A source *may* contain a "types" element listing the query types used for the source's domains. The supported types
+     are "A", "AAAA", "CNAME", "MX", "TXT", "DNAME", and "NAPTR" (e.g. for SIP/ENUM environments). If unspecified, the query types
+     set by the "ipv4" and "ipv6" noise elements are used. The "ANY" type is also supported if the "allowAny" noise element is set.
+  *  A source *may* contain a "loadMode" element specifying how a refresh is loaded into the database. The "replace" mode
+     purges the existing data for the source's label and reloads the full dataset. The "merge" mode only inserts domains
+     not already present, which reduces write churn for large datasets that rarely change. Note that domains dropped
+     from the source are never removed in "merge" mode. If unspecified, the default value is "replace".
+     In either mode, a refresh is skipped if the downloaded data is identical to that loaded previously.
 
   "sources": [
-    { "url": "http://example.com/domains/domainlist.csv.zip", "column": 1, "label": "source1", "refresh": "24h" }
+    { "url": "http://example.com/domains/domainlist.csv.zip", "column": 1, "label": "source1", "refresh": "24h", "loadMode": "replace", "types": ["A", "MX"] },
+    { "domains": ["example.com", "example.net"], "label": "source2" },
+    { "url": "http://example.com/domains/hosts.txt", "format": "hosts", "label": "source3", "refresh": "30 5 * * *" },
+    { "url": "file:///var/lib/dns-noise/queries.txt", "format": "replay", "label": "source4" }
   ],
 
+  The "proxy" element is *optional* and if omitted the source downloads will use the proxy (if any) defined by the
+  standard HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables.
+  It specifies the URL of a proxy used for fetching the sources. Both HTTP ("http://proxy.example.com:3128") and
+  SOCKS5 ("socks5://proxy.example.com:1080") proxies are supported. Credentials may be included in the URL if required.
+
+  "proxy": "socks5://proxy.example.com:1080",
+
+  The "insecureSkipVerify" element is *optional* and if omitted the certificates of https sources will be verified.
+  It is a boolean flag which disables certificate verification for the source fetches, which may be needed for internal
+  servers using self-signed certificates or an internal CA. A warning is logged when enabled. The default value is false.
+
+  "insecureSkipVerify": false,
+
+  The "outInterface" element is *optional* and if omitted the outbound connections are routed by the system as usual.
+  It specifies the name of a network interface which the DNS queries and the source downloads are bound to (SO_BINDTODEVICE),
+  e.g. for making the noise egress via a VPN or a dedicated interface. The pihole connections are not bound.
+  Binding is only supported on Linux and typically requires the CAP_NET_RAW capability; the interface must exist at startup.
+
+  "outInterface": "wg0",
+
+  The "logOutput" element is *optional* and if omitted the log output will be written to stderr.
+  It specifies the destination for the log output: "stderr", "syslog", or the path of a file the log output is appended to.
+  Log rotation for a file is left to external tools (e.g. logrotate with the "copytruncate" option).
+  The "syslog" destination is not supported on Windows.
+
+  "logOutput": "/var/log/dns-noise.log",
+
   The "noise" block is *optional* and if omitted the system defaults will be used.
   It contains a set of attributes that define how the application behaves.
   * The "minPeriod" element specifies the minimum interval  permitted for queries. The default value is 100ms.
     A command-line argument specifying the minPeriod will overwrite the default or configuration value.
-    The period must be parsable by Go's time.ParseDuration() and be less than that of the maxPeriod.
+    The period must be parsable by Go's time.ParseDuration() and be less than or equal to that of the maxPeriod.
   * The "maxPeriod" element specifies the maximum interval permitted for queries. The default value is 15s.
     A command-line argument specifying the maxPeriod will overwrite the default or configuration value.
-    The period must be parsable by Go's time.ParseDuration() and be greater than that of minPeriod.
+    The period must be parsable by Go's time.ParseDuration() and be greater than 0 and greater than or equal to that of minPeriod.
+    If the minPeriod and maxPeriod are equal, queries are issued at that constant interval (plus any jitter).
   * The "dbPath" element specifies the path to locate the database containing the list of domains.
     The default location is in the system's tempory directory with the filename of "dns-noise.db".
     The location must have permissions for file creation and write access.
@@ -79,13 +174,181 @@ Here is an annotated reference for the configuration file format:
   * The "ipv6" element is a boolean flag indicating whether DNS request for the IPv6 address should be utilized.
     This is a request for the "AAAA" record from the DNS zone and is not dependent on using an IPv4 or IPv6 network.
     The default value is false.
+  * The "maxTldPercentage" element *may* specify the maximum percentage (1-100) of noise queries permitted for any single
+    top-level domain (e.g. "com"). Domains from an over-represented TLD will be passed over in favor of another selection.
+    The default value is 0 which disables the cap. Do not include a percentage sign (%) with the value.
+  * The "jitterPercentage" element *may* specify the maximum random delay added to each sleep period, expressed as
+    a percentage (0-100) of that period. A value of 0 disables the jitter entirely, which is useful for deterministic testing.
+    The default value is 10. Do not include a percentage sign (%) with the value.
+  * The "fetchParallelism" element *may* specify the maximum number of sources downloaded concurrently at startup.
+    The downloaded sources are still imported into the database one at a time. The default value is 4.
+  * The "stagger" element *may* specify the maximum random gap between the starts of the source downloads at startup, so the
+    downloads are spread over time rather than made in a single burst. The interval must be parsable by Go's time.ParseDuration().
+    The default value is 0 which starts all of the downloads (up to the fetchParallelism) at once.
+  * The "warnDomains" element *may* specify the expected maximum number of domains in the database across all sources.
+    If exceeded after a source is loaded, a warning is logged and the "dns_noise_domains_exceeded" metric is set; unlike
+    "maxTotalDomains", nothing is skipped. This catches rows accumulating across refreshes. The default value is 0 which
+    disables the check. The deprecated "maxDomains" element of the noise block is still accepted in its place.
+  * The "maxTotalDomains" element *may* specify the maximum number of domains in the database across all sources, as a safety
+    ceiling for constrained hardware (e.g. a Raspberry Pi). Once reached while loading a source, the remaining domains of the
+    source are skipped (and logged), so the sources loaded first take precedence. Use the "maxDomains" element of the sources
+    to sample them proportionally instead. The default value is 0 which removes the limit.
+  * The "concurrent" element is a boolean flag indicating whether the queries for each of a domain's record types (e.g. "A" and
+    "AAAA") are sent together without waiting on the earlier responses, as stub resolvers do for dual-stack lookups.
+    The default value is false, which sends each query only after the previous response is received.
+  * The "syntheticPercentage" element *may* specify the percentage (0-100) of queries made for randomly generated domains
+    (e.g. "k3jd8slq.com") instead of a domain from the sources. These will almost always result in NXDOMAIN responses.
+    The default value is 0. Do not include a percentage sign (%) with the value.
+  * The "syntheticTlds" element *may* specify the list of top-level domains used for the randomly generated domains.
+    Plausible TLDs should be used so the generated domains do not themselves become a fingerprint.
+    The default value is ["com", "net", "org", "io"].
+  * The "recentSize" element *may* specify the number of recently selected domains remembered in order to avoid querying the
+    same domain repeatedly in a short window. A recently selected domain is passed over in favor of another selection.
+    The default value is 0 which disables the check.
+  * The "recentTtl" element *may* specify how long a selected domain is remembered. The default value is 5m.
+    The interval must be parsable by Go's time.ParseDuration().
+  * The "answerCacheSize" element *may* specify the number of answers (by name and query type) remembered until their TTL
+    expires, to mimic the upstream queries of a caching resolver. A domain with an unexpired answer would be served from the
+    resolver's cache, so it is passed over in favor of another selection. Negative answers (NXDOMAIN or no records) are
+    remembered for the TTL of their SOA record. The default value is 0 which disables the check.
+  * The "serverFailures" element *may* specify the number of consecutive failed queries after which a nameserver is skipped
+    (failing over directly to the next nameserver). The default value is 3. A value of 0 disables skipping nameservers.
+  * The "serverCooldown" element *may* specify how long a failed nameserver is skipped before it is tried again.
+    The default value is 30s. The interval must be parsable by Go's time.ParseDuration().
+  * The "adaptive" element is a boolean flag indicating whether the number of successful and failed (e.g. NXDOMAIN) lookups
+    of each domain is tracked in the database. Domains which have failed more often than they have succeeded are passed over
+    in favor of another selection, so the noise increasingly resembles resolvable traffic. The queries
+    for the mail authentication records of a domain (see "mailPercentage") are not tallied. Note that the tally for a
+    source's domains is reset when a source is refreshed in the "replace" mode. The default value is false.
+  * The "pruneFailures" element *may* specify the number of failed lookups after which a domain that has never been
+    successfully resolved is deleted from the database. It is only used if "adaptive" is enabled.
+    The default value is 0 which disables the pruning.
+  * The "recursionDesired" element is a boolean flag indicating whether the queries are sent with the RD (recursion desired)
+    bit set. Clearing it exercises the non-recursive behavior of the nameservers (e.g. an authoritative server).
+    The default value is true.
+  * The "chaosRate" element *may* specify the fraction (0.0-1.0) of queries made in the CHAOS class for a server
+    identification name (e.g. "version.bind" TXT CH) instead of a domain from the sources. A small fraction of
+    real-world traffic and probing takes this form. The default value is 0 which disables the CHAOS queries.
+  * The "followCNAME" element is a boolean flag indicating whether a CNAME answer without records for its target is followed
+    with a query for the target (an "A" query unless the original query was for "AAAA"), as a client resolving the chain would.
+    Up to 8 CNAMEs are followed for a lookup. The default value is false.
+  * The "tcpRate" element *may* specify the fraction (0.0-1.0) of queries sent over TCP rather than UDP, as real resolvers
+    occasionally do. The default value is 0 which sends all of the queries over UDP.
+  * The "useSystemResolvers" element *may* specify the fraction (0.0-1.0) of queries sent to a nameserver picked at random
+    from the system's /etc/resolv.conf (re-read every 5 minutes) instead of the configured nameservers, as a roaming client
+    using whatever resolver DHCP hands it would. The configured nameservers are still used if that nameserver fails.
+    The default value is 0 which only uses the configured nameservers.
+  * The "drainTimeout" element *may* specify how long the queries in flight are given to complete on shutdown (SIGINT or
+    SIGTERM) before they are interrupted. No new queries are started once shutdown begins. A second signal exits immediately.
+    The default value is 5s. The interval must be parsable by Go's time.ParseDuration().
+  * The "selfTestDomain" element *may* specify a known-good domain queried against each nameserver at startup so a
+    misconfigured nameserver is reported immediately. The default value is "example.com". An empty value disables the test.
+  * The "selfTestFatal" element is a boolean flag indicating whether a nameserver failing the startup test is a fatal error.
+    The default value is false, which only logs a warning.
+  * The "profileFile" element *may* specify the path of a JSON file with a captured traffic profile: a histogram of the
+    intervals between queries and the relative weights of the query types (see Profile for the format). The intervals are
+    sampled from the histogram instead of between the minPeriod and maxPeriod (unless the pihole activity is used), and a
+    single query type is sampled for each domain instead of the "ipv4"/"ipv6" types. The jitter and any schedule still apply.
+    It is a fatal error if the file cannot be loaded. The default is to not use a traffic profile.
+  * The "retryTruncatedOverTCP" element is a boolean flag indicating whether a truncated (TC bit set) UDP response is retried
+    over TCP against the same nameserver, as a real resolver would. The default value is true.
+  * The "vacuumPeriod" element *may* specify how often the database is vacuumed to reclaim the space left by the purges of
+    refreshed sources. The vacuum is run between noise queries so it never competes with a selection, although it may
+    briefly delay the next query. The query planner statistics are also updated after every refresh regardless.
+    The default value is 0 which disables the vacuum. The interval must be parsable by Go's time.ParseDuration().
+  * The "mailPercentage" element *may* specify the percentage (0-100) of domains for which a mail authentication TXT query
+    is made instead, as mail servers do: the DMARC policy ("_dmarc.example.com"), a DKIM key with a common selector
+    ("selector1._domainkey.example.com"), or the SPF record of the domain itself. The default value is 0.
+    Do not include a percentage sign (%) with the value.
+  * The "maxAnswers" element *may* specify the maximum number of answer records in a response that are processed individually
+    (counted by record type and logged). Any further records are only counted in aggregate against the query type, which bounds
+    the work and log volume for an unusually large response. The default value is 50. A value of 0 removes the limit.
+  * The "dualStackProbability" element *may* specify the fraction (0.0-1.0) of domains queried for both the "A" and "AAAA"
+    records when both the "ipv4" and "ipv6" elements are enabled. The remaining domains are queried for just one of them,
+    chosen at random. The order of the two queries is also randomized. The default value is 1.0 which queries both for every domain.
+  * The "indexedSelectionRows" element *may* specify the table size at or above which a random domain is selected by a random
+    row id rather than a random row offset. The offset is exactly uniform but sqlite steps over every preceding row to reach it,
+    while the row id is located directly but slightly favors the rows following those deleted by a refresh.
+    The default value is 100000. A value of 0 always selects by row id.
+  * The "cacheSize" element *may* specify the size (in KiB) of the sqlite page cache of each database connection. A larger
+    cache holds more of a large database in memory, reducing the I/O for each random selection at the cost of memory.
+    The default value is 0 which leaves the sqlite default (2000 KiB).
+  * The "pageSize" element *may* specify the sqlite page size (in bytes, a power of two from 512 to 65536). Larger pages
+    suit large databases read randomly. It only applies to a newly created database file or once the database is vacuumed.
+    The default value is 0 which leaves the sqlite default (4096 bytes).
+  * The "dnssecOk" element is a boolean flag indicating whether the queries are sent with the DO (DNSSEC OK) bit set, which
+    asks a validating resolver to return the DNSSEC records and exercises its validation. The responses marked as authenticated
+    (AD bit set) are counted by the "dns_noise_dnssec_ad_total" metric regardless. The default value is false.
+  * The "idleProbability" element *may* specify the fraction (0.0-1.0) of sleep periods after which no query is issued, leaving
+    a longer gap as when a user pauses (e.g. reading a page). Idle periods are not counted against the --once number of queries.
+    The default value is 0 which issues a query after every sleep period.
+  * The "allowAny" element is a boolean flag indicating whether "ANY" is accepted as a query type in the "types" of a source or
+    of the traffic profile. Most resolvers refuse ANY queries (NOTIMP or REFUSED) or return a minimal HINFO record (RFC 8482);
+    these responses are counted by their rcode (or as "RFC8482") and are not treated as failures. The default value is false.
+  * The "selection" element *may* specify how the domains are selected. The "random" selection picks each domain independently
+    at random, so some domains may never be picked. The "sweep" selection walks through all of the domains in a shuffled order
+    (reshuffled for each pass and whenever a source is refreshed), so every domain is eventually queried. The domains are not
+    passed over in the "sweep" selection, so the sourceWeight, maxTldPercentage, recentSize, answerCacheSize, and adaptive elements do not apply.
+    The default value is "random".
+  * The "slowQuery" element *may* specify the response time above which a query is counted as slow by the
+    "dns_noise_slow_queries_total" metric (by nameserver), which is simpler to alert on than the response time histogram.
+    The default value is 1s. A value of 0 disables the count. The interval must be parsable by Go's time.ParseDuration().
+  * The "coverPercentage" element *may* specify the percentage (0-100) of queries made for the decoys of an active cover set
+    (see "coverSets") instead of a domain from the sources. The default value is 0. Do not include a percentage sign (%) with the value.
+  * The "coverWindow" element *may* specify how long a cover set stays active after its domain is seen in the pihole's queries.
+    The default value is 10m. The interval must be parsable by Go's time.ParseDuration().
+  * The "minRefresh" element *may* specify the minimum interval between refreshes of a source, guarding against a typo in a
+    source's "refresh" element (e.g. "1s") repeatedly downloading a large list and getting the host banned by the provider.
+    A shorter refresh interval is raised to the minimum with a warning, and the matching times of a cron expression within
+    the minimum of the previous refresh are skipped. The default value is 5m. The interval must be parsable by Go's time.ParseDuration().
 
   "noise": {
     "minPeriod": "100ms",
     "maxPeriod": "15s",
     "dbPath": "/tmp/dns-noise.db",
     "ipv4": true,
-    "ipv6": true
+    "ipv6": true,
+    "maxTldPercentage": 50,
+    "jitterPercentage": 10,
+    "fetchParallelism": 4,
+    "stagger": "0s",
+    "warnDomains": 2000000,
+    "maxTotalDomains": 5000000,
+    "concurrent": true,
+    "syntheticPercentage": 5,
+    "syntheticTlds": ["com", "net", "org", "io"],
+    "recentSize": 1000,
+    "recentTtl": "5m",
+    "answerCacheSize": 10000,
+    "serverFailures": 3,
+    "serverCooldown": "30s",
+    "adaptive": true,
+    "pruneFailures": 5,
+    "recursionDesired": true,
+    "chaosRate": 0.001,
+    "followCNAME": true,
+    "tcpRate": 0.02,
+    "useSystemResolvers": 0.1,
+    "drainTimeout": "5s",
+    "selfTestDomain": "example.com",
+    "selfTestFatal": false,
+    "profileFile": "/usr/local/etc/dns-noise-profile.json",
+    "retryTruncatedOverTCP": true,
+    "vacuumPeriod": "24h",
+    "mailPercentage": 5,
+    "maxAnswers": 50,
+    "dualStackProbability": 0.7,
+    "indexedSelectionRows": 100000,
+    "cacheSize": 65536,
+    "pageSize": 8192,
+    "dnssecOk": true,
+    "idleProbability": 0.2,
+    "allowAny": false,
+    "selection": "random",
+    "slowQuery": "1s",
+    "minRefresh": "5m",
+    "coverPercentage": 20,
+    "coverWindow": "10m"
   },
 
   The "pihole" block is *optional* and if omitted the application will not utilize pihole activity for determining noise thresholds.
@@ -96,27 +359,98 @@ Here is an annotated reference for the configuration file format:
   * The "host" element *must* specify the hostname or IP address of the pihole server. The pihole must be listening on that interface,
     so check the pihole settings especially if running the noise generator on the same host as the pihole.
     If the host is not specified, pihole activity will not be enabled.
+  * The "scheme" element *may* specify the scheme ("http" or "https") used to access the pihole's admin API.
+    The default is "http". Using "https" (e.g. via a reverse proxy) avoids sending the authToken unencrypted.
+  * The "basePath" element *may* specify the path to the pihole's admin API, which is accessed as scheme://host/basePath/api.php.
+    The default is "admin". This may be needed if the pihole is fronted by a reverse proxy on a subpath.
+  * The "insecureSkipVerify" element *may* be specified with a boolean (true/false) value to disable certificate verification
+    when using the "https" scheme. This may be needed for a reverse proxy using a self-signed certificate or an internal CA.
+    A warning is logged when enabled. The default value is false.
   * The "authToken" element *must* contain the encrypted web password for accessing the pihole's admin API. Please note that the queries
-    to the pihole are sent *unencrypted* and the token value is accessible to traffic sniffers as the pihole does not support https.
+    to the pihole are sent *unencrypted* and the token value is accessible to traffic sniffers as the pihole does not support https
+    (unless fronted by a reverse proxy accessed with the "https" scheme).
     Do *not* use if there is even a remote chance of untrusted actors on the network.
+  * The "authTokenFile" element *may* specify the path to the pihole's setupVars.conf file, from which the "WEBPASSWORD" value
+    is read as the authToken. This avoids duplicating the token when running on the same host as the pihole. It is only used if
+    the "authToken" element is not specified. If the file cannot be read, pihole activity will not be enabled.
   * The "activityPeriod" element *may* specify the time interval used to calculate the running average for the pihole query activity.
     The default is use a 5 minute window for examining query activity. The interval must be parsable by Go's time.ParseDuration().
   * The "refresh" element *may* specify the frequency the pihole will be queried to calculate the moving average.
     The default refresh frequency is 1 minute. The frequency must be parsable by Go's time.ParseDuration().
+  * The "warmup" element *may* specify the interval after startup during which random values between the minPeriod and
+    maxPeriod are used before switching over to the pihole activity. This avoids a spike in the noise rate on startup.
+    The default warmup is the same as the activityPeriod. The interval must be parsable by Go's time.ParseDuration().
   * The "filter" element *may* specify a hostname that is used to exclude activity from the moving average.
     This may be desired in order to exclude the queries originating from the DNS noise host in order to just report on the "live" traffic.
+    The pihole reports a client by IP address if it cannot resolve its hostname, so the filter may instead be an IP address
+    (e.g. "192.168.1.53") or a network in CIDR form (e.g. "192.168.1.0/28") which is matched against the client IP address.
+    Otherwise, the filter matches the start of the client hostname.
+  * The "columns" element *may* specify the (zero-based) positions of the fields within each query row reported by the pihole,
+    as the layout of the rows differs across pihole versions. The "domain" element gives the position of the queried domain
+    (used by the cover sets) and the "client" element that of the client (used by the filter). The defaults are 2 and 3
+    respectively. Rows without the expected number of fields are logged as a sign of a changed layout and counted as live
+    activity, as the client they originate from is unknown.
+  * The "subtractNoise" element *may* be specified with a boolean (true/false) value indicating whether an estimate of the noise
+    queries (the noise rate realized since the previous refresh) is subtracted from the pihole activity. This guards against
+    the noise feeding back into its own rate if the filter does not exclude it. If the filter does exclude it, the noise
+    rate is slightly below the noisePercentage. The correction is exposed as the "dns_noise_pihole_correction" metric.
+    The default value is true.
+  * The "failureGrace" element *may* specify the number of consecutive failed refreshes of the pihole activity (e.g. the pihole
+    is briefly unavailable, or reports no activity) during which the last good query rate is kept. Once exceeded, random values
+    between the minPeriod and maxPeriod are used until the pihole activity is available again. The default value is 3.
   * The "noisePercentage" element *may* be specified and must be in the range of 1-100 for the pihole functionality to be enabled.
     This element allows the noise generator to dynamically adjust its traffic levels to the stated percentage of "live" traffic.
     The default value is 10. Do not include a percentage sign (%) with the value.
 
   "pihole": {
     "host": "pihole.example.com",
+    "scheme": "http",
+    "basePath": "admin",
+    "insecureSkipVerify": false,
     "authToken": "pihole_authtoken_goes_here",
+    "authTokenFile": "/etc/pihole/setupVars.conf",
     "activityPeriod": "5m",
     "refresh": "1m",
+    "warmup": "5m",
     "filter": "noise.example.com",
+    "columns": { "domain": 2, "client": 3 },
+    "subtractNoise": true,
+    "failureGrace": 3,
+    "noisePercentage": 10
+  },
+
+  The "activitySource" block is *optional* and provides the live query rate from a generic HTTP endpoint for those not
+  running a pihole, e.g. a Prometheus query of the resolver's request rate or a custom endpoint. It is used the same way as
+  the pihole activity (which takes precedence if both are enabled) and is enabled if the "url" element is specified.
+  * The "url" element specifies the URL which is fetched (GET) for the current live query rate in queries per second.
+  * The "field" element *may* specify the dot-separated path of the rate within a JSON response, with array elements given
+    by their index (e.g. "data.result.0.value.1" for a Prometheus query). The rate may be a number or a numeric string.
+    If omitted, the whole response body is expected to be the rate.
+  * The "headers" element *may* specify HTTP headers added to the request, with environment variables in the values expanded.
+  * The "insecureSkipVerify" element *may* be specified to disable the certificate verification of an https URL. The default value is false.
+  * The "refresh", "warmup", "subtractNoise", "failureGrace", and "noisePercentage" elements are the same as for the pihole.
+    The defaults are the same, except that there is no warmup by default, and at least 1 query per refresh is kept when
+    subtracting the noise.
+
+  "activitySource": {
+    "url": "http://prometheus.example.com:9090/api/v1/query?query=sum(rate(coredns_dns_requests_total[5m]))",
+    "field": "data.result.0.value.1",
+    "headers": { "Authorization": "Bearer ${PROMETHEUS_TOKEN}" },
+    "insecureSkipVerify": false,
+    "refresh": "1m",
+    "warmup": "0s",
+    "subtractNoise": true,
+    "failureGrace": 3,
     "noisePercentage": 10
-  }
+  },
+
+  The "activityProvider" element is *optional* and chooses where the live query rate the noise rate is derived from is taken:
+  "pihole" (the pihole block), "activitySource" (the activitySource block), or "none" to always use the random timing (or the
+  traffic profile) while keeping the blocks configured, e.g. for the validate option. A chosen provider which is not enabled
+  is logged and the random timing is used instead. The default value is "auto", which uses the pihole if it is enabled,
+  otherwise the activity source if it is enabled.
+
+  "activityProvider": "auto",
 
 	The "metrics" block is *optional* and if omitted the application will not emit any metrics for scraping.
 	If the metrics block is incorrectly formatted, it may result in a panic upon service launch or difficulty in scraping.
@@ -125,22 +459,140 @@ Here is an annotated reference for the configuration file format:
   * The "enabled" element *may* be specified with a boolean (true/false) value. The default value is false.
   * The "port" element *may* be specified. The default value is 6001. Care should be made when selecting a port
     to pick a port that is not already in use on that host or in a restricted range.
+  * The "portRetries" element *may* specify the number of subsequent ports (port+1, port+2, ...) tried if the port is already
+    in use. If no port can be bound, the failure is logged and the noise queries continue without the scrape endpoint.
+    The default value is 0 which only tries the configured port.
   *	The "path" element *may* be specified. The default value is "/metrics" as that is the convential path for Prometheus
    	log scraping. Access to the path should be restricted to external networks as part of good security practices.
+  * The "pushGateway" element *may* specify the URL of a Prometheus Pushgateway. If specified, the metrics are pushed to it
+    at the end of a run made with the --once flag, as such a short-lived run cannot be scraped. The push is independent of
+    the "enabled" element. The default is to not push metrics.
+  * The "pushJob" element *may* specify the job name used when pushing metrics. The default value is "dns-noise".
+  * The "labels" element *may* specify constant labels (e.g. { "profile": "home" }) applied to every metric. This distinguishes
+    the metrics of multiple instances scraped into the same Prometheus. The default is to not add any labels.
+  * The "pushInterval" element *may* specify an interval for periodically pushing the metrics while running indefinitely.
+    The default value is 0 which disables the periodic push. The interval must be parsable by Go's time.ParseDuration().
+  * The "maxRequestsInFlight" element *may* limit the number of scrapes served concurrently. Further scrapes are answered with
+    a 503 (Service Unavailable) status. The default value is 0 which does not limit the scrapes.
+  * The "timeout" element *may* specify the time a scrape is given to gather the metrics before it is answered with a 503
+    (Service Unavailable) status. The default value is 0 which does not time out. It must be parsable by Go's time.ParseDuration().
+  * The "errorHandling" element *may* specify how an error gathering the metrics is handled: "http" answers the scrape with a
+    500 (Internal Server Error) status, "continue" serves the metrics that could be gathered, and "panic" stops the application.
+    Errors are logged in any case. The default value is "http".
 
 	"metrics": {
 		"enabled": false,
 		"port": 6001,
-		"path": "/metrics"
-	}
+		"portRetries": 0,
+		"path": "/metrics",
+		"pushGateway": "http://pushgateway.example.com:9091",
+		"pushJob": "dns-noise",
+		"pushInterval": "1m",
+		"labels": { "profile": "home" },
+		"maxRequestsInFlight": 4,
+		"timeout": "10s",
+		"errorHandling": "http"
+	},
+
+  The "queryLog" block is *optional* and if omitted the application will not log the individual answer records received.
+  Errors and non-success response codes (e.g. NXDOMAIN) are always logged regardless of these settings.
+  * The "enabled" element *may* be specified with a boolean (true/false) value. The default value is false.
+  * The "format" element *may* specify a Go text/template used for each answer record logged.
+    The fields available to the template are .Type, .Name, .Answer, .Rcode, and .Server.
+    The default format is "{{.Type}}: {{.Name}}->{{.Answer}}; {{.Rcode}}".
+  * The "file" element *may* specify the path of a file to which a record of every query (including retries and failovers) is
+    appended, for offline analysis of the generated traffic: the time, domain, query type, nameserver, rcode (or "ERROR" if
+    there was no response), and response time in milliseconds. It is independent of the "enabled" element.
+    The file is never rotated or truncated, so its size is left to external tools (e.g. logrotate with the "copytruncate" option).
+    It is a fatal error if the file cannot be opened. The default is to not record the queries.
+  * The "fileFormat" element *may* specify the format of the records: "jsonl" (one JSON object per line) or "csv"
+    (in the field order above). The default value is "jsonl".
+
+  "queryLog": {
+    "enabled": false,
+    "format": "{{.Type}}: {{.Name}}->{{.Answer}}; {{.Rcode}}",
+    "file": "/var/log/dns-noise-queries.jsonl",
+    "fileFormat": "jsonl"
+  },
+
+  The "ecs" block is *optional* and if omitted the queries are sent without an EDNS Client Subnet (ECS) option.
+  The ECS option (RFC 7871) is sent by resolvers on behalf of their clients, and it varies the responses of geo-steered
+  services (e.g. CDNs) by the client's network.
+  * The "enabled" element *may* be specified with a boolean (true/false) value. The default value is false.
+  * The "subnets" element *may* list the client subnets (in CIDR form, e.g. "203.0.113.0/24") of which one is picked at random
+    for each query. If omitted, a random public IPv4 /24 subnet is generated for each query.
+
+  "ecs": {
+    "enabled": false,
+    "subnets": ["203.0.113.0/24", "2001:db8::/56"]
+  },
+
+  The "coverSets" block is *optional* and if omitted no decoy queries are made.
+  It maps sensitive domains to pools of similar decoy domains (e.g. of the same category), so an observer of the DNS traffic
+  can't tell which of the apparent interests is the real one. If the pihole is enabled, a domain's decoys are only queried for
+  the coverWindow after the domain (or a subdomain) is seen in the pihole's queries; otherwise all of the decoys are always
+  queried. The percentage of queries made for the decoys is set by the "coverPercentage" noise element.
+
+  "coverSets": {
+    "clinic.example.com": ["hospital.example.net", "pharmacy.example.org", "gym.example.com"]
+  },
+
+  The "schedule" block is *optional* and if omitted the query rate is the same at all times of the day.
+  It defines windows of the day during which the query rate is scaled, e.g. to match the quiet and active hours of a household.
+  * The "timezone" element *may* specify the IANA time zone (e.g. "America/New_York") the windows are expressed in.
+    The default is the local time zone of the host.
+  * The "windows" element *may* list the windows, each with a "start" and "end" time of day (in "15:04" form) and a
+    "multiplier" for the query rate during the window (e.g. 0.1 for a tenth of the usual rate). The multiplier must be
+    greater than 0 and the resulting interval between queries is not restricted to the minPeriod/maxPeriod range.
+    A window may span midnight (e.g. "22:00" to "06:00"). If windows overlap, the first one listed is used.
+
+  "schedule": {
+    "timezone": "America/New_York",
+    "windows": [
+      { "start": "02:00", "end": "06:00", "multiplier": 0.1 },
+      { "start": "18:00", "end": "22:00", "multiplier": 1.5 }
+    ]
+  },
+
+  The "profiles" block is *optional* and if omitted the noise is made as configured above at all times.
+  It defines named noise profiles (e.g. "aggressive", "stealth", "office"), each overriding some of the configuration while active.
+  * A profile *may* contain "minPeriod" and "maxPeriod" elements replacing those of the noise block.
+  * A profile *may* contain a "sourceWeights" element mapping source labels to their selection weight (see "sourceWeight").
+    Sources not listed keep their own weight (or 1). A weight of 0 excludes the source while the profile is active.
+  * A profile *may* contain a "schedule" element replacing the schedule block.
+  The "profile" element *may* name the profile active at startup, which the '--profile' command-line option overrides.
+  The default is no profile, which uses the configuration as is. If the metrics endpoint is enabled, the active profile may be
+  read with a GET of "/profile" and switched at runtime with a POST of the profile's name (an empty body for no profile),
+  e.g. curl -d stealth http://noise.example.com:6001/profile
+  As the endpoint alters the noise, access to it should be restricted the same as for the metrics.
+
+  "profiles": {
+    "stealth": { "minPeriod": "5s", "maxPeriod": "60s", "sourceWeights": { "source2": 0 } },
+    "aggressive": { "minPeriod": "50ms", "maxPeriod": "2s",
+      "schedule": { "windows": [ { "start": "00:00", "end": "06:00", "multiplier": 0.5 } ] } }
+  },
+  "profile": "stealth"
 }
 */
 type Config struct {
-	NameServers []NameServer `json:"nameservers"`
-	Noise       Noise        `json:"noise"`
-	Sources     []Source     `json:"sources"`
-	Pihole      Pihole       `json:"pihole"`
-	Metrics     Metrics      `json:"metrics"`
+	NameServers          []NameServer            `json:"nameservers"`
+	DuplicateNameServers string                  `json:"duplicateNameservers"`
+	Noise                Noise                   `json:"noise"`
+	Sources              []Source                `json:"sources"`
+	Proxy                string                  `json:"proxy"`
+	Insecure             bool                    `json:"insecureSkipVerify"`
+	OutInterface         string                  `json:"outInterface"`
+	LogOutput            string                  `json:"logOutput"`
+	Pihole               Pihole                  `json:"pihole"`
+	ActivitySource       ActivitySource          `json:"activitySource"`
+	ActivityProvider     string                  `json:"activityProvider"`
+	Metrics              Metrics                 `json:"metrics"`
+	QueryLog             QueryLog                `json:"queryLog"`
+	Schedule             Schedule                `json:"schedule"`
+	Ecs                  Ecs                     `json:"ecs"`
+	CoverSets            map[string][]string     `json:"coverSets"`
+	Profiles             map[string]NoiseProfile `json:"profiles"`
+	Profile              string                  `json:"profile"`
 }
 
 type NameServer struct {
@@ -163,47 +615,220 @@ func (ns *NameServer) UnmarshalJSON(data []byte) error {
 }
 
 type Noise struct {
-	DbPath    string   `json:"dbPath"`
-	MinPeriod Duration `json:"minPeriod"`
-	MaxPeriod Duration `json:"maxPeriod"`
-	IPv4      bool     `json:ipv4"`
-	IPv6      bool     `json:ipv6"`
+	DbPath           string   `json:"dbPath"`
+	MinPeriod        Duration `json:"minPeriod"`
+	MaxPeriod        Duration `json:"maxPeriod"`
+	IPv4             bool     `json:"ipv4"`
+	IPv6             bool     `json:"ipv6"`
+	MaxTldPct        int      `json:"maxTldPercentage"`
+	JitterPct        int      `json:"jitterPercentage"`
+	FetchPar         int      `json:"fetchParallelism"`
+	Stagger          Duration `json:"stagger"`
+	WarnDomains      int      `json:"warnDomains"`
+	MaxTotalDomains  int      `json:"maxTotalDomains"`
+	Concurrent       bool     `json:"concurrent"`
+	SyntheticPct     int      `json:"syntheticPercentage"`
+	SyntheticTlds    []string `json:"syntheticTlds"`
+	RecentSize       int      `json:"recentSize"`
+	RecentTtl        Duration `json:"recentTtl"`
+	AnswerCacheSize  int      `json:"answerCacheSize"`
+	ServerFailures   int      `json:"serverFailures"`
+	ServerCooldown   Duration `json:"serverCooldown"`
+	Adaptive         bool     `json:"adaptive"`
+	PruneFailures    int      `json:"pruneFailures"`
+	RecursionDesired bool     `json:"recursionDesired"`
+	ChaosRate        float64  `json:"chaosRate"`
+	FollowCname      bool     `json:"followCNAME"`
+	TcpRate          float64  `json:"tcpRate"`
+	SystemRate       float64  `json:"useSystemResolvers"`
+	DrainTimeout     Duration `json:"drainTimeout"`
+	SelfTestDomain   string   `json:"selfTestDomain"`
+	SelfTestFatal    bool     `json:"selfTestFatal"`
+	ProfileFile      string   `json:"profileFile"`
+	RetryTruncated   bool     `json:"retryTruncatedOverTCP"`
+	VacuumPeriod     Duration `json:"vacuumPeriod"`
+	MailPct          int      `json:"mailPercentage"`
+	MaxAnswers       int      `json:"maxAnswers"`
+	DualStackProb    float64  `json:"dualStackProbability"`
+	IndexedRows      int      `json:"indexedSelectionRows"`
+	CacheSize        int      `json:"cacheSize"`
+	PageSize         int      `json:"pageSize"`
+	DnssecOk         bool     `json:"dnssecOk"`
+	IdleProb         float64  `json:"idleProbability"`
+	AllowAny         bool     `json:"allowAny"`
+	Selection        string   `json:"selection"`
+	SlowQuery        Duration `json:"slowQuery"`
+	MinRefresh       Duration `json:"minRefresh"`
+	CoverPct         int      `json:"coverPercentage"`
+	CoverWindow      Duration `json:"coverWindow"`
 }
 
 // UnmarshalJSON provides an interface for customized processing of the Noise struct.
 // It performs initialization of select fields to default values prior to the actual unmarshaling.
 // The default values will be overwritten if present in the JSON blob.
 func (n *Noise) UnmarshalJSON(data []byte) error {
+	n.setDefaults()
+
+	// Need to avoid circular looping here
+	// the deprecated "maxDomains" key (easily confused with that of the sources) is still accepted for warnDomains
+	type Alias Noise
+	tmp := struct {
+		*Alias
+		MaxDomains int `json:"maxDomains"`
+	}{Alias: (*Alias)(n)}
+
+	err := json.Unmarshal(data, &tmp)
+	if err != nil {
+		return err
+	}
+	if tmp.MaxDomains > 0 && n.WarnDomains == 0 {
+		log.Println("The noise \"maxDomains\" element is deprecated; use \"warnDomains\" instead")
+		n.WarnDomains = tmp.MaxDomains
+	}
+
+	return nil
+}
+
+// setDefaults initializes the Noise struct with the default values.
+// They are applied both when unmarshaling the noise block and for a config without one (see newConfig).
+func (n *Noise) setDefaults() {
 	n.IPv4 = true
+	n.Selection = "random"
+	n.RecursionDesired = true
+	n.RetryTruncated = true
+	n.MaxAnswers = 50
+	n.DualStackProb = 1
+	n.IndexedRows = 100000
+	n.JitterPct = 10
+	n.FetchPar = 4
+	n.SyntheticTlds = []string{"com", "net", "org", "io"}
+	n.RecentTtl, _ = parseDuration("5m")
+	n.ServerFailures = 3
+	n.ServerCooldown, _ = parseDuration("30s")
+	n.DrainTimeout, _ = parseDuration("5s")
+	n.SlowQuery, _ = parseDuration("1s")
+	n.MinRefresh, _ = parseDuration("5m")
+	n.CoverWindow, _ = parseDuration("10m")
+	n.SelfTestDomain = "example.com"
 	n.DbPath = filepath.Join(os.TempDir(), "dns-noise.db")
 	n.MinPeriod, _ = parseDuration("100ms")
 	n.MaxPeriod, _ = parseDuration("15s")
+}
+
+type Source struct {
+	Label       string            `json:"label"`
+	Url         string            `json:"url"`
+	Column      int               `json:"column"`
+	ColumnName  string            `json:"columnName"`
+	ParseErrors string            `json:"parseErrors"`
+	Format      string            `json:"format"`
+	Types       []string          `json:"types"`
+	Domains     []string          `json:"domains"`
+	Headers     map[string]string `json:"headers"`
+	MaxDomains  int               `json:"maxDomains"`
+	Weight      float64           `json:"sourceWeight"`
+	Refresh     Duration          `json:"refresh"`
+	LoadMode    string            `json:"loadMode"`
+	RefreshCron *cronSchedule
+	Timestamp   time.Time
+	Hash        string
+}
+
+// UnmarshalJSON provides an interface for customized processing of the Source struct.
+// It performs initialization of select fields to default values prior to the actual unmarshaling.
+// The default values will be overwritten if present in the JSON blob.
+func (s *Source) UnmarshalJSON(data []byte) error {
+	s.LoadMode = "replace"
+	s.Format = "csv"
+	s.ParseErrors = "abort"
 
 	// Need to avoid circular looping here
-	type Alias Noise
-	tmp := (*Alias)(n)
+	// the refresh is unmarshaled separately as it may be either a duration or a cron expression
+	type Alias Source
+	tmp := struct {
+		*Alias
+		Refresh json.RawMessage `json:"refresh"`
+	}{Alias: (*Alias)(s)}
 
-	return json.Unmarshal(data, tmp)
-}
+	err := json.Unmarshal(data, &tmp)
+	if err != nil || len(tmp.Refresh) == 0 {
+		return err
+	}
 
-type Source struct {
-	Label     string   `json:"label"`
-	Url       string   `json:"url"`
-	Column    int      `json:"column"`
-	Refresh   Duration `json:"refresh"`
-	Timestamp time.Time
+	// durations are tried first for backward compatibility
+	if s.Refresh.UnmarshalJSON(tmp.Refresh) == nil {
+		return nil
+	}
+
+	var spec string
+	err = json.Unmarshal(tmp.Refresh, &spec)
+	if err != nil {
+		return err
+	}
+	s.RefreshCron, err = parseCron(spec)
+
+	return err
 }
 
 type Pihole struct {
-	Host            string   `json:"host"`
-	AuthToken       string   `json:"authToken"`
-	ActivityPeriod  Duration `json:"activityPeriod"`
+	Host           string        `json:"host"`
+	Scheme         string        `json:"scheme"`
+	BasePath       string        `json:"basePath"`
+	Insecure       bool          `json:"insecureSkipVerify"`
+	AuthToken      string        `json:"authToken"`
+	AuthTokenFile  string        `json:"authTokenFile"`
+	ActivityPeriod Duration      `json:"activityPeriod"`
+	Filter         string        `json:"filter"`
+	Columns        PiholeColumns `json:"columns"`
+	ActivityRate
+}
+
+// ActivityRate holds the settings and the state of the rate calculation shared by the pihole and the activity source.
+// It is embedded in their blocks, so its elements are given directly within them.
+type ActivityRate struct {
 	Refresh         Duration `json:"refresh"`
-	Filter          string   `json:"filter"`
+	Warmup          Duration `json:"warmup"`
+	SubtractNoise   bool     `json:"subtractNoise"`
+	FailureGrace    int      `json:"failureGrace"`
 	NoisePercentage int      `json:"noisePercentage"`
 	Enabled         bool
+	Provider        ActivityProvider
+	Name            string
+	Window          time.Duration
+	Started         time.Time
 	Timestamp       time.Time
 	SleepPeriod     time.Duration
+	QueriesSent     int64
+	Failures        int
+}
+
+type ActivitySource struct {
+	Url      string            `json:"url"`
+	Field    string            `json:"field"`
+	Headers  map[string]string `json:"headers"`
+	Insecure bool              `json:"insecureSkipVerify"`
+	ActivityRate
+}
+
+// UnmarshalJSON provides an interface for customized processing of the ActivitySource struct.
+// It performs initialization of select fields to default values prior to the actual unmarshaling.
+// The default values will be overwritten if present in the JSON blob.
+func (a *ActivitySource) UnmarshalJSON(data []byte) error {
+	a.NoisePercentage = 10
+	a.SubtractNoise = true
+	a.FailureGrace = 3
+	a.Refresh, _ = parseDuration("1m")
+
+	// Need to avoid circular looping here
+	type Alias ActivitySource
+	tmp := (*Alias)(a)
+
+	return json.Unmarshal(data, tmp)
+}
+
+type PiholeColumns struct {
+	Domain int `json:"domain"`
+	Client int `json:"client"`
 }
 
 // UnmarshalJSON provides an interface for customized processing of the Pihole struct.
@@ -211,20 +836,44 @@ type Pihole struct {
 // The default values will be overwritten if present in the JSON blob.
 func (p *Pihole) UnmarshalJSON(data []byte) error {
 	p.NoisePercentage = 10
+	p.SubtractNoise = true
+	p.FailureGrace = 3
+	p.Columns = PiholeColumns{Domain: 2, Client: 3}
+	p.Scheme = "http"
+	p.BasePath = "admin"
 	p.ActivityPeriod, _ = parseDuration("5m")
 	p.Refresh, _ = parseDuration("1m")
+	p.Warmup = Duration(-1)
 
 	// Need to avoid circular looping here
 	type Alias Pihole
 	tmp := (*Alias)(p)
 
-	return json.Unmarshal(data, tmp)
+	err := json.Unmarshal(data, tmp)
+	if err != nil {
+		return err
+	}
+
+	// the warmup defaults to the activity period, which is only known after unmarshaling
+	if p.Warmup < 0 {
+		p.Warmup = p.ActivityPeriod
+	}
+
+	return nil
 }
 
 type Metrics struct {
-	Enabled bool   `json:"enabled"`
-	Path    string `json:"path"`
-	Port    int    `json:"port"`
+	Enabled             bool              `json:"enabled"`
+	Path                string            `json:"path"`
+	Port                int               `json:"port"`
+	PortRetries         int               `json:"portRetries"`
+	PushGateway         string            `json:"pushGateway"`
+	PushJob             string            `json:"pushJob"`
+	PushInterval        Duration          `json:"pushInterval"`
+	Labels              map[string]string `json:"labels"`
+	MaxRequestsInFlight int               `json:"maxRequestsInFlight"`
+	Timeout             Duration          `json:"timeout"`
+	ErrorHandling       string            `json:"errorHandling"`
 }
 
 // UnmarshalJSON provides an interface for customized processing of the Metrics struct.
@@ -234,6 +883,8 @@ func (m *Metrics) UnmarshalJSON(data []byte) error {
 	m.Port = 6001
 	m.Enabled = false
 	m.Path = "metrics"
+	m.PushJob = "dns-noise"
+	m.ErrorHandling = "http"
 
 	type Alias Metrics
 	tmp := (*Alias)(m)
@@ -241,6 +892,70 @@ func (m *Metrics) UnmarshalJSON(data []byte) error {
 	return json.Unmarshal(data, tmp)
 }
 
+type QueryLog struct {
+	Enabled    bool   `json:"enabled"`
+	Format     string `json:"format"`
+	File       string `json:"file"`
+	FileFormat string `json:"fileFormat"`
+}
+
+// UnmarshalJSON provides an interface for customized processing of the QueryLog struct.
+// It performs initialization of select fields to default values prior to the actual unmarshaling.
+// The default values will be overwritten if present in the JSON blob.
+func (q *QueryLog) UnmarshalJSON(data []byte) error {
+	q.Enabled = false
+	q.Format = "{{.Type}}: {{.Name}}->{{.Answer}}; {{.Rcode}}"
+	q.FileFormat = "jsonl"
+
+	type Alias QueryLog
+	tmp := (*Alias)(q)
+
+	return json.Unmarshal(data, tmp)
+}
+
+type Ecs struct {
+	Enabled bool     `json:"enabled"`
+	Subnets []string `json:"subnets"`
+}
+
+type NoiseProfile struct {
+	MinPeriod     Duration           `json:"minPeriod"`
+	MaxPeriod     Duration           `json:"maxPeriod"`
+	SourceWeights map[string]float64 `json:"sourceWeights"`
+	Schedule      *Schedule          `json:"schedule"`
+}
+
+type Schedule struct {
+	Timezone string   `json:"timezone"`
+	Windows  []Window `json:"windows"`
+	Location *time.Location
+}
+
+type Window struct {
+	Start      ClockTime `json:"start"`
+	End        ClockTime `json:"end"`
+	Multiplier float64   `json:"multiplier"`
+}
+
+// UnmarshalJSON provides an interface for customized processing of the Schedule struct.
+// It performs initialization of select fields to default values prior to the actual unmarshaling.
+// The default values will be overwritten if present in the JSON blob.
+// The timezone is loaded once unmarshaled; an unknown timezone is returned as an error.
+func (s *Schedule) UnmarshalJSON(data []byte) error {
+	s.Timezone = "Local"
+
+	type Alias Schedule
+	tmp := (*Alias)(s)
+
+	err := json.Unmarshal(data, tmp)
+	if err != nil {
+		return err
+	}
+
+	s.Location, err = time.LoadLocation(s.Timezone)
+	return err
+}
+
 // loadFlags parses the CLI arguments passed into the Flags structure.
 // Unrecognized flags will be ignored.
 // An initialized Flags struct will be returned which contains either the passed in values or defaults.
@@ -260,10 +975,30 @@ func loadFlags() *Flags {
 	flag.StringVar(&f.DbPath, "d", "/tmp/dns-noise.db", "Path to noise database file (shorthand)")
 	flag.DurationVar(&f.MinPeriod, "min", f.MinPeriod, "Minimum time period for issuing noise queries")
 	flag.DurationVar(&f.MaxPeriod, "max", f.MaxPeriod, "Maximum time period for issuing noise queries")
+	flag.Int64Var(&f.Seed, "seed", 0, "Deterministic seed for random values (testing only)")
+	flag.IntVar(&f.Once, "once", 0, "Issue the given number of noise queries and exit")
+	flag.BoolVar(&f.Validate, "validate", false, "Validate the configuration and source reachability and exit")
+	flag.BoolVar(&f.Status, "status", false, "Show a live status line on stderr")
+	flag.StringVar(&f.Profile, "profile", "", "Name of the noise profile to start with")
+	flag.StringVar(&f.RefreshLabels, "refresh-on-start", "", "Comma-separated labels of the sources reloaded at startup when reusing the database")
 
 	// process the flags passed in on the CLI
 	flag.Parse()
 
+	// an optional command may follow the flags, with its own set of flags
+	// e.g. dns-noise -c dns-noise.conf export --out domains.csv
+	f.Command = flag.Arg(0)
+	switch f.Command {
+	case "":
+		break
+	case "export":
+		export := flag.NewFlagSet("export", flag.ExitOnError)
+		export.StringVar(&f.ExportPath, "out", "domains.csv", "Path to exported CSV file")
+		export.Parse(flag.Args()[1:])
+	default:
+		log.Fatalf("Unrecognized command '%s'", f.Command)
+	}
+
 	return f
 }
 
@@ -280,26 +1015,90 @@ func isFlagPassed(flagName string) bool {
 	return found
 }
 
-// loadConfig reads in and parses the named file for the configuration values.
+// configExample is a minimal configuration shown when no configuration file is found.
+const configExample = `{
+  "sources": [
+    { "url": "http://s3-us-west-1.amazonaws.com/umbrella-static/top-1m.csv.zip", "column": 1, "label": "umbrella", "refresh": "24h" }
+  ]
+}`
+
+// configSearchPaths returns the paths searched for the default configuration file, in order: the current working directory,
+// "/etc/dns-noise/", and "~/.config/dns-noise/" (if the home directory is known).
+func configSearchPaths(name string) []string {
+	paths := []string{name, filepath.Join("/etc/dns-noise", name)}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "dns-noise", name))
+	}
+
+	return paths
+}
+
+// openConfig opens the configuration file.
+// If the file was named explicitly with the -c/--conf flag, only that file is opened. Otherwise, the standard locations
+// are searched for the default file (see configSearchPaths) and the first one found is opened.
+// If no file is found, it is a fatal error reported with the paths searched and an example of a minimal configuration.
+func openConfig(flags *Flags) *os.File {
+	if isFlagPassed("conf") || isFlagPassed("c") {
+		jsonFile, err := os.Open(flags.ConfigFile)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return jsonFile
+	}
+
+	paths := configSearchPaths(flags.ConfigFile)
+	for _, path := range paths {
+		jsonFile, err := os.Open(path)
+		if err == nil {
+			log.Printf("Using configuration file '%s'", path)
+			return jsonFile
+		}
+		if !os.IsNotExist(err) {
+			log.Fatal(err.Error())
+		}
+	}
+
+	log.Fatalf("No configuration file found; searched:\n  %s\nSpecify the file with -c, or create one such as:\n%s",
+		strings.Join(paths, "\n  "), configExample)
+	return nil
+}
+
+// newConfig creates a Config with the defaults of the blocks which are needed even if the block is omitted.
+// The defaults of a block are otherwise only set when the block is unmarshaled (see Noise.UnmarshalJSON).
+func newConfig() *Config {
+	c := new(Config)
+	c.Noise.setDefaults()
+
+	return c
+}
+
+// loadConfig reads in and parses the configuration file for the configuration values (see openConfig).
 // The file is expected to be in JSON format. Command line flags will overwrite the values (if any) found in the configuration.
 // If successful, the processed configuration will be returned. If an error is encountered, it will be treated as a fatal error.
 func loadConfig(flags *Flags) *Config {
-	jsonFile, err := os.Open(flags.ConfigFile)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
+	jsonFile := openConfig(flags)
 	defer jsonFile.Close()
 
 	byteValue, _ := ioutil.ReadAll(jsonFile)
 
-	c := new(Config)
-	err = json.Unmarshal(byteValue, c)
+	c := newConfig()
+	err := json.Unmarshal(byteValue, c)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
+	// the token file is read only if the token itself wasn't supplied; an unreadable file simply leaves the pihole disabled
+	if c.Pihole.AuthToken == "" && c.Pihole.AuthTokenFile != "" {
+		token, err := piholeReadToken(c.Pihole.AuthTokenFile)
+		if err != nil {
+			log.Printf("Unable to read pihole token; pihole disabled: %v", err)
+		}
+		c.Pihole.AuthToken = token
+	}
+
 	// checks to see if necessary elements for Pihole access are present
 	c.Pihole.Enabled = piholeEnabled(&c.Pihole)
+	c.ActivitySource.Enabled = c.ActivitySource.Url != "" && c.ActivitySource.NoisePercentage > 0
 
 	// overwrite config vars that were set explicitly with a command-line flag
 	if isFlagPassed("min") {
@@ -312,14 +1111,175 @@ func loadConfig(flags *Flags) *Config {
 		c.Noise.DbPath = flags.DbPath
 	}
 
+	if flags.Once < 0 {
+		log.Fatal("Number of queries for once must not be negative")
+	}
+
 	// bad config! no soup for you!
-	if c.Noise.MinPeriod > c.Noise.MaxPeriod {
-		log.Fatal("Min period exceeds max period")
+	err = validateConfig(c)
+	if err != nil {
+		log.Fatal(err.Error())
 	}
 
 	return c
 }
 
+// validateConfig checks the configuration values for consistency.
+// It returns a descriptive error for the first problem found, or nil if the configuration is valid.
+func validateConfig(c *Config) error {
+	switch c.DuplicateNameServers {
+	case "", "remove", "keep", "fatal":
+		break
+	default:
+		return fmt.Errorf("Unrecognized duplicateNameservers '%s'", c.DuplicateNameServers)
+	}
+	// a zero max period would issue the queries without any pause, flooding the nameservers
+	if c.Noise.MaxPeriod <= 0 {
+		return fmt.Errorf("Max period must be greater than 0")
+	}
+	if c.Noise.MinPeriod < 0 {
+		return fmt.Errorf("Min period must not be negative")
+	}
+	if c.Noise.MinPeriod > c.Noise.MaxPeriod {
+		return fmt.Errorf("Min period exceeds max period")
+	}
+	if c.Noise.ChaosRate < 0 || c.Noise.ChaosRate > 1 {
+		return fmt.Errorf("Chaos rate %v is not in the range 0.0-1.0", c.Noise.ChaosRate)
+	}
+	if c.Noise.TcpRate < 0 || c.Noise.TcpRate > 1 {
+		return fmt.Errorf("TCP rate %v is not in the range 0.0-1.0", c.Noise.TcpRate)
+	}
+	if c.Noise.IdleProb < 0 || c.Noise.IdleProb >= 1 {
+		return fmt.Errorf("Idle probability %v is not in the range 0.0-1.0 (exclusive)", c.Noise.IdleProb)
+	}
+	if c.Noise.DualStackProb < 0 || c.Noise.DualStackProb > 1 {
+		return fmt.Errorf("Dual stack probability %v is not in the range 0.0-1.0", c.Noise.DualStackProb)
+	}
+	if c.Noise.PageSize != 0 && (c.Noise.PageSize < 512 || c.Noise.PageSize > 65536 || c.Noise.PageSize&(c.Noise.PageSize-1) != 0) {
+		return fmt.Errorf("Page size %d is not a power of two from 512 to 65536", c.Noise.PageSize)
+	}
+	// the selection is unset if the noise block is omitted entirely
+	if c.Noise.Selection != "" && c.Noise.Selection != "random" && c.Noise.Selection != "sweep" {
+		return fmt.Errorf("Unrecognized selection '%s'", c.Noise.Selection)
+	}
+	if c.Noise.SystemRate < 0 || c.Noise.SystemRate > 1 {
+		return fmt.Errorf("System resolvers rate %v is not in the range 0.0-1.0", c.Noise.SystemRate)
+	}
+	for _, subnet := range c.Ecs.Subnets {
+		if _, _, err := net.ParseCIDR(subnet); err != nil {
+			return fmt.Errorf("Invalid ECS subnet '%s': %v", subnet, err)
+		}
+	}
+	for _, w := range c.Schedule.Windows {
+		if w.Multiplier <= 0 {
+			return fmt.Errorf("Schedule window %v-%v has a multiplier of %v; it must be greater than 0", w.Start, w.End, w.Multiplier)
+		}
+	}
+	if c.QueryLog.FileFormat != "" && c.QueryLog.FileFormat != "jsonl" && c.QueryLog.FileFormat != "csv" {
+		return fmt.Errorf("Unrecognized query log fileFormat '%s'", c.QueryLog.FileFormat)
+	}
+	if c.Pihole.Scheme != "" && c.Pihole.Scheme != "http" && c.Pihole.Scheme != "https" {
+		return fmt.Errorf("Unrecognized pihole scheme '%s'", c.Pihole.Scheme)
+	}
+	if c.Pihole.Columns.Domain < 0 || c.Pihole.Columns.Client < 0 {
+		return fmt.Errorf("Pihole columns must not be negative")
+	}
+	if c.Metrics.ErrorHandling != "" && c.Metrics.ErrorHandling != "http" && c.Metrics.ErrorHandling != "continue" && c.Metrics.ErrorHandling != "panic" {
+		return fmt.Errorf("Unrecognized metrics errorHandling '%s'", c.Metrics.ErrorHandling)
+	}
+	if c.Metrics.MaxRequestsInFlight < 0 {
+		return fmt.Errorf("Metrics maxRequestsInFlight must not be negative")
+	}
+	switch c.ActivityProvider {
+	case "", "auto", "pihole", "activitySource", "none":
+	default:
+		return fmt.Errorf("Unrecognized activityProvider '%s'", c.ActivityProvider)
+	}
+
+	labels := make(map[string]bool)
+	for _, s := range c.Sources {
+		if s.Label == "" {
+			return fmt.Errorf("Source '%s' has no label; a unique label is required so its refresh cannot purge other sources", s.Url)
+		}
+		if labels[s.Label] {
+			return fmt.Errorf("Source label '%s' is used more than once; a unique label is required so its refresh cannot purge other sources", s.Label)
+		}
+		labels[s.Label] = true
+
+		if s.Weight < 0 {
+			return fmt.Errorf("Source '%s' has a negative sourceWeight", s.Label)
+		}
+		if s.Url == "" && len(s.Domains) == 0 {
+			return fmt.Errorf("Source '%s' has neither a url nor domains", s.Label)
+		}
+		if _, _, err := objectStoreURL(s.Url); err != nil {
+			return fmt.Errorf("Source '%s': %v", s.Label, err)
+		}
+
+		if s.LoadMode != "replace" && s.LoadMode != "merge" {
+			return fmt.Errorf("Unrecognized loadMode '%s' for source '%s'", s.LoadMode, s.Label)
+		}
+		if s.Format != "csv" && s.Format != "hosts" && s.Format != "replay" {
+			return fmt.Errorf("Unrecognized format '%s' for source '%s'", s.Format, s.Label)
+		}
+		if s.ParseErrors != "abort" && s.ParseErrors != "skip" {
+			return fmt.Errorf("Unrecognized parseErrors '%s' for source '%s'", s.ParseErrors, s.Label)
+		}
+		for _, t := range s.Types {
+			if !dnsSupportedType(t, c.Noise.AllowAny) {
+				return fmt.Errorf("Unsupported query type '%s' for source '%s'", t, s.Label)
+			}
+		}
+	}
+
+	// a profile's periods are checked as they end up, as a profile may only override one of them
+	if _, ok := c.Profiles[c.Profile]; c.Profile != "" && !ok {
+		return fmt.Errorf("Unknown noise profile '%s'", c.Profile)
+	}
+	// the profiles and their weights are checked in sorted order, so the same error is reported on every run
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := c.Profiles[name]
+		min, max := c.Noise.MinPeriod, c.Noise.MaxPeriod
+		if p.MinPeriod > 0 {
+			min = p.MinPeriod
+		}
+		if p.MaxPeriod > 0 {
+			max = p.MaxPeriod
+		}
+		if min > max {
+			return fmt.Errorf("Min period exceeds max period for noise profile '%s'", name)
+		}
+		weighted := make([]string, 0, len(p.SourceWeights))
+		for label := range p.SourceWeights {
+			weighted = append(weighted, label)
+		}
+		sort.Strings(weighted)
+		for _, label := range weighted {
+			w := p.SourceWeights[label]
+			if !labels[label] {
+				return fmt.Errorf("Noise profile '%s' weights unknown source '%s'", name, label)
+			}
+			if w < 0 {
+				return fmt.Errorf("Noise profile '%s' has a negative weight for source '%s'", name, label)
+			}
+		}
+		if p.Schedule != nil {
+			for _, w := range p.Schedule.Windows {
+				if w.Multiplier <= 0 {
+					return fmt.Errorf("Schedule window %v-%v of noise profile '%s' has a multiplier of %v; it must be greater than 0", w.Start, w.End, name, w.Multiplier)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 // The Duration type provides enables the JSON module to process strings as time.Durations.
 // While time.Duration is available as a native type for CLI flags, it is not for the JSON parser.
 // Note that in Go, you cannot define new methods on a non-local type so this workaround is the
@@ -372,3 +1332,42 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 		return fmt.Errorf("Invalid Duration specification: '%v'", value)
 	}
 }
+
+// The ClockTime type enables the JSON module to process strings (e.g. "05:30") as a time of day.
+// It is stored as the offset from midnight.
+type ClockTime time.Duration
+
+// Duration returns the offset from midnight as the time.Duration native type of the time module.
+func (c ClockTime) Duration() time.Duration {
+	return time.Duration(c)
+}
+
+// String returns the time of day in "15:04" form.
+func (c ClockTime) String() string {
+	d := time.Duration(c)
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// MarshalJSON supplies an interface for processing ClockTime values.
+// It returns a byte array and any error encountered.
+func (c ClockTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+// UnmarshalJSON supplies an interface for processing ClockTime values expressed in "15:04" form.
+// It accepts a byte array and returns any error encountered.
+func (c *ClockTime) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return fmt.Errorf("Invalid time of day specification: '%v'", s)
+	}
+
+	*c = ClockTime(time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute)
+	return nil
+}
@@ -0,0 +1,99 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestConfigWithoutNoise checks that a config without a noise block still gets the documented noise defaults.
+func TestConfigWithoutNoise(t *testing.T) {
+	c := newConfig()
+	err := json.Unmarshal([]byte(`{"sources": [{"domains": ["example.com"], "label": "source1"}]}`), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := c.Noise
+	if !n.RecursionDesired {
+		t.Error("recursionDesired is false; want true")
+	}
+	if !n.RetryTruncated {
+		t.Error("retryTruncatedOverTCP is false; want true")
+	}
+	if !n.IPv4 {
+		t.Error("ipv4 is false; want true")
+	}
+	if n.MaxAnswers != 50 {
+		t.Errorf("maxAnswers is %d; want 50", n.MaxAnswers)
+	}
+	if n.DualStackProb != 1 {
+		t.Errorf("dualStackProbability is %v; want 1", n.DualStackProb)
+	}
+	if n.ServerFailures != 3 {
+		t.Errorf("serverFailures is %d; want 3", n.ServerFailures)
+	}
+	if n.DrainTimeout.Duration() != 5*time.Second {
+		t.Errorf("drainTimeout is %v; want 5s", n.DrainTimeout.Duration())
+	}
+	if n.MinPeriod.Duration() != 100*time.Millisecond || n.MaxPeriod.Duration() != 15*time.Second {
+		t.Errorf("periods are %v-%v; want 100ms-15s", n.MinPeriod.Duration(), n.MaxPeriod.Duration())
+	}
+	if n.Selection != "random" {
+		t.Errorf("selection is '%s'; want 'random'", n.Selection)
+	}
+
+	err = validateConfig(c)
+	if err != nil {
+		t.Errorf("validateConfig: %v", err)
+	}
+}
+
+// TestConfigNoiseOverrides checks that the values of a noise block override the defaults while the others are kept.
+func TestConfigNoiseOverrides(t *testing.T) {
+	c := newConfig()
+	err := json.Unmarshal([]byte(`{"noise": {"recursionDesired": false, "maxAnswers": 10}}`), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Noise.RecursionDesired {
+		t.Error("recursionDesired is true; want false")
+	}
+	if c.Noise.MaxAnswers != 10 {
+		t.Errorf("maxAnswers is %d; want 10", c.Noise.MaxAnswers)
+	}
+	if c.Noise.ServerFailures != 3 {
+		t.Errorf("serverFailures is %d; want 3", c.Noise.ServerFailures)
+	}
+}
+
+// TestConfigWarnDomains checks that the noise block's deprecated "maxDomains" key is still accepted for warnDomains,
+// and that it doesn't override warnDomains or the maxDomains of a source.
+func TestConfigWarnDomains(t *testing.T) {
+	tests := []struct {
+		noise string
+		want  int
+	}{
+		{`{"warnDomains": 100}`, 100},
+		{`{"maxDomains": 200}`, 200},
+		{`{"warnDomains": 100, "maxDomains": 200}`, 100},
+	}
+	for _, test := range tests {
+		c := newConfig()
+		err := json.Unmarshal([]byte(`{"noise": `+test.noise+`, "sources": [{"url": "https://example.com/top-1m.csv", "label": "source1", "maxDomains": 50}]}`), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Noise.WarnDomains != test.want {
+			t.Errorf("%s: warnDomains is %d; want %d", test.noise, c.Noise.WarnDomains, test.want)
+		}
+		if c.Sources[0].MaxDomains != 50 {
+			t.Errorf("%s: source maxDomains is %d; want 50", test.noise, c.Sources[0].MaxDomains)
+		}
+	}
+}
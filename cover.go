@@ -0,0 +1,94 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coverSet contains the decoy domains queried to cover the real (sensitive) domain, and until when it is active.
+type coverSet struct {
+	domain      string
+	decoys      []string
+	activeUntil time.Time
+}
+
+// coverSets contains the cover sets, ordered by their domain so the selection is reproducible with a deterministic seed.
+// If coverAlways is set (i.e. no pihole is available to observe the real traffic), all of the sets are always active;
+// otherwise a set is active for coverWindow after its domain is observed in the pihole's queries.
+var coverSets []*coverSet
+var coverAlways bool
+var coverWindow time.Duration
+var coverMutex sync.Mutex
+
+// coverConfig sets up the cover sets from the configuration.
+// Domains without any decoys are ignored.
+func coverConfig(sets map[string][]string, n *Noise, piholeEnabled bool) {
+	for domain, decoys := range sets {
+		if len(decoys) == 0 {
+			continue
+		}
+		coverSets = append(coverSets, &coverSet{domain: strings.TrimSuffix(strings.ToLower(domain), "."), decoys: decoys})
+	}
+	sort.Slice(coverSets, func(i, j int) bool { return coverSets[i].domain < coverSets[j].domain })
+
+	coverAlways = !piholeEnabled
+	coverWindow = n.CoverWindow.Duration()
+	if len(coverSets) > 0 {
+		log.Printf("Loaded %d cover sets", len(coverSets))
+	}
+}
+
+// coverObserve activates the cover sets whose domain (or a subdomain of it) appears in the pihole's queries.
+// The domain of each query is read from the given column of the rows returned by the pihole's getAllQueries.
+func coverObserve(queries [][]string, column int) {
+	if len(coverSets) == 0 || coverAlways {
+		return
+	}
+
+	coverMutex.Lock()
+	defer coverMutex.Unlock()
+
+	for _, query := range queries {
+		if len(query) <= column {
+			continue
+		}
+
+		name := strings.TrimSuffix(strings.ToLower(query[column]), ".")
+		for _, c := range coverSets {
+			if name == c.domain || strings.HasSuffix(name, "."+c.domain) {
+				if time.Now().After(c.activeUntil) {
+					log.Printf("Activated cover set for '%s'", c.domain)
+				}
+				c.activeUntil = time.Now().Add(coverWindow)
+			}
+		}
+	}
+}
+
+// coverDomain picks a random decoy domain from a random active cover set.
+// It returns false if no cover set is active.
+func coverDomain(rng *rand.Rand) (string, bool) {
+	coverMutex.Lock()
+	defer coverMutex.Unlock()
+
+	var active []*coverSet
+	for _, c := range coverSets {
+		if coverAlways || time.Now().Before(c.activeUntil) {
+			active = append(active, c)
+		}
+	}
+	if len(active) == 0 {
+		return "", false
+	}
+
+	c := active[rng.Intn(len(active))]
+	return c.decoys[rng.Intn(len(c.decoys))], true
+}
@@ -0,0 +1,161 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule contains a parsed 5-field cron expression ("minute hour day-of-month month day-of-week").
+// Each field is a bitmask of the values permitted for that field.
+type cronSchedule struct {
+	spec   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// whether the day-of-month and day-of-week fields were restricted (i.e. not "*")
+	domSet bool
+	dowSet bool
+}
+
+// cronMaxSearch bounds the search for the next matching time so an expression that can never match (e.g. "0 0 31 2 *")
+// does not search forever.
+const cronMaxSearch = 5 * 366 * 24 * time.Hour
+
+// parseCron parses a standard 5-field cron expression (e.g. "30 5 * * *" for daily at 05:30).
+// Each field may be "*", a value, a range ("1-5"), a step ("*/15" or "0-30/10"), or a comma-separated list of these.
+// The day-of-week is 0-7 where both 0 and 7 are Sunday. Names for months and weekdays are not supported.
+// If the expression cannot be parsed, it returns an error.
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid cron expression '%s': expected 5 fields", spec)
+	}
+
+	c := &cronSchedule{spec: spec}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("Invalid cron expression '%s': %v", spec, err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("Invalid cron expression '%s': %v", spec, err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("Invalid cron expression '%s': %v", spec, err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("Invalid cron expression '%s': %v", spec, err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("Invalid cron expression '%s': %v", spec, err)
+	}
+
+	// Sunday may be given as either 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domSet = fields[2] != "*"
+	c.dowSet = fields[4] != "*"
+
+	return c, nil
+}
+
+// parseCronField parses a single cron field into a bitmask of the permitted values within the min-max range.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in '%s'", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid range in '%s'", part)
+				}
+			} else if step > 1 {
+				// a step from a single value (e.g. "5/15") runs to the end of the range
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("'%s' is out of the range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// next returns the first time after t matching the schedule, in t's location.
+// If the day-of-month and day-of-week are both restricted, a day matching either is accepted (as with the standard cron).
+// If no matching time is found within cronMaxSearch, the zero time is returned.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	limit := t.Add(cronMaxSearch)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// dayMatches checks whether the day of t matches the day-of-month and day-of-week fields.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+
+	if c.domSet && c.dowSet {
+		return domMatch || dowMatch
+	}
+
+	return domMatch && dowMatch
+}
+
+// String returns the original cron expression.
+func (c *cronSchedule) String() string {
+	return c.spec
+}
@@ -5,19 +5,74 @@
 package main
 
 import (
+	"bufio"
 	"database/sql"
 	"encoding/csv"
-	_ "github.com/mattn/go-sqlite3"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
 	"io"
 	"log"
 	"math/rand"
 	"os"
+	"strings"
+	"time"
 )
 
+// dbBusyTimeout is the time (in milliseconds) sqlite will retry an operation against a locked database before failing.
+const dbBusyTimeout = 5000
+
+// dbIndexedRows is the span of row ids at or above which a random domain is selected by a random row id (using the
+// primary key index) rather than a random OFFSET, which sqlite implements by stepping over that many rows.
+var dbIndexedRows int64 = 100000
+
+// dbCacheSize is the size (in KiB) of the page cache of each database connection and dbPageSize is the page size (in bytes)
+// of a newly created database. A value of 0 leaves the sqlite default.
+var dbCacheSize int
+var dbPageSize int
+
+// dbMaxTotalDomains is the maximum number of domains in the database across all of the sources. Once reached, no further
+// domains are inserted while loading. A value of 0 removes the limit.
+var dbMaxTotalDomains int
+
+// dbDriver is the name of the sqlite driver which applies the cache and page size to each new connection.
+// The go-sqlite3 DSN has no parameters for either, so they are set by a PRAGMA on connecting.
+const dbDriver = "sqlite3_dns_noise"
+
+func init() {
+	sql.Register(dbDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if dbPageSize > 0 {
+				_, err := conn.Exec(fmt.Sprintf("PRAGMA page_size=%d", dbPageSize), nil)
+				if err != nil {
+					return err
+				}
+			}
+			if dbCacheSize > 0 {
+				// a negative cache_size is in KiB rather than pages
+				_, err := conn.Exec(fmt.Sprintf("PRAGMA cache_size=-%d", dbCacheSize), nil)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
+}
+
+// dbConfig sets the database options from the noise configuration.
+func dbConfig(n *Noise) {
+	dbIndexedRows = int64(n.IndexedRows)
+	dbCacheSize = n.CacheSize
+	dbPageSize = n.PageSize
+	dbMaxTotalDomains = n.MaxTotalDomains
+}
+
 // dbOpen will open the database specified in path or create the database at the path if it doesn't exist.
+// The connection is configured to retry operations against a locked database rather than failing immediately.
 // If successful, it will return a database connection pointer.
 func dbOpen(path string) *sql.DB {
-	db, err := sql.Open("sqlite3", path)
+	db, err := sql.Open(dbDriver, fmt.Sprintf("%s?_busy_timeout=%d", path, dbBusyTimeout))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -43,139 +98,635 @@ func dbCreateSchema(db *sql.DB) {
 	}
 
 	// create the schema
-	schema := `CREATE TABLE Domains ("DomainId" INTEGER PRIMARY KEY AUTOINCREMENT, "Domain" TEXT NOT NULL, "Label" TEXT NOT NULL);`
+	schema := `CREATE TABLE Domains ("DomainId" INTEGER PRIMARY KEY AUTOINCREMENT, "Domain" TEXT NOT NULL, "Label" TEXT NOT NULL, "Types" TEXT NOT NULL DEFAULT '', "Successes" INTEGER NOT NULL DEFAULT 0, "Failures" INTEGER NOT NULL DEFAULT 0);`
 	_, err = db.Exec(schema)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// the unique index lets duplicate domains for a label be skipped on insert (needed for merging refreshes)
+	index := `CREATE UNIQUE INDEX DomainsLabel ON Domains ("Domain", "Label");`
+	_, err = db.Exec(index)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// selecting from a single label (for weighted sources) needs its rows located without a table scan
+	index = `CREATE INDEX DomainsByLabel ON Domains ("Label");`
+	_, err = db.Exec(index)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-// dbLoadCSV reads the specified file into the database.
-// The data is associated with the given label to provide a means for independently refreshing if multiple sources are loaded.
-// If data with the label already exist in the database, it will be dropped prior to loading the new set.
-// The column indicates which column in the data file has the list of domains (0-based index).
-func dbLoadCSV(db *sql.DB, path, label string, column int) {
-	// validate connection to database is still valid
-	err := db.Ping()
+// dbMigrateSchema brings the schema of a reused database up to date, as it may have been created by an older version.
+// Any missing columns are added with their defaults and any missing indexes are created.
+// It is a fatal error if the database has no domains table or can't be migrated (e.g. duplicate domains for a label
+// prevent the unique index); the database must then be recreated by running without --reusedb.
+func dbMigrateSchema(db *sql.DB) {
+	rows, err := db.Query(`PRAGMA table_info(Domains)`)
 	if err != nil {
 		log.Fatal(err)
 	}
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk)
+		if err != nil {
+			rows.Close()
+			log.Fatal(err)
+		}
+		columns[name] = true
+	}
+	rows.Close()
+	if len(columns) == 0 {
+		log.Fatal("Reused database has no domains table; recreate the database by running without --reusedb")
+	}
 
-	// remove any data previously associated with the label first
-	dbPurgeData(db, label)
+	migrations := []struct {
+		column string
+		stmt   string
+	}{
+		{"Types", `ALTER TABLE Domains ADD COLUMN "Types" TEXT NOT NULL DEFAULT ''`},
+		{"Successes", `ALTER TABLE Domains ADD COLUMN "Successes" INTEGER NOT NULL DEFAULT 0`},
+		{"Failures", `ALTER TABLE Domains ADD COLUMN "Failures" INTEGER NOT NULL DEFAULT 0`},
+		{"", `CREATE UNIQUE INDEX IF NOT EXISTS DomainsLabel ON Domains ("Domain", "Label")`},
+		{"", `CREATE INDEX IF NOT EXISTS DomainsByLabel ON Domains ("Label")`},
+	}
+	for _, m := range migrations {
+		if m.column != "" && columns[m.column] {
+			continue
+		}
+		_, err = db.Exec(m.stmt)
+		if err != nil {
+			log.Fatalf("Unable to migrate the reused database (%v); recreate the database by running without --reusedb", err)
+		}
+		if m.column != "" {
+			log.Printf("Added column '%s' to the reused database", m.column)
+		}
+	}
+}
 
+// dbLoadCSV reads the specified CSV file for the source into the database.
+// The source's column indicates which column in the data file has the list of domains (0-based index).
+// If the source has a column name, the first record is read as the header row and the column is the one with that name.
+// Records without the column are skipped, as are malformed records (e.g. a stray quote) if the source's parse error
+// handling is "skip"; otherwise a malformed record aborts the load. See dbLoadDomains for how the data is loaded.
+func dbLoadCSV(db *sql.DB, path string, s *Source) error {
 	csvFile, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer csvFile.Close()
 
+	// records are not required to have the same number of fields, as only the one column is used
+	reader := csv.NewReader(csvFile)
+	reader.FieldsPerRecord = -1
+	column := s.Column
+	if s.ColumnName != "" {
+		header, err := reader.Read()
+		if err != nil {
+			return fmt.Errorf("Unable to read the header row for source '%s': %v", s.Label, err)
+		}
+		column, err = dbHeaderColumn(header, s.ColumnName)
+		if err != nil {
+			return fmt.Errorf("Source '%s': %v", s.Label, err)
+		}
+	}
+
+	return dbLoadDomains(db, s, func() ([]string, error) {
+		record, err := reader.Read()
+		if _, ok := err.(*csv.ParseError); ok && s.ParseErrors == "skip" {
+			log.Printf("Skipping malformed record for source '%s': %v", s.Label, err)
+			metricsDomainsSkipped("malformed", s.Label)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if column >= len(record) {
+			metricsDomainsSkipped("malformed", s.Label)
+			return nil, nil
+		}
+
+		return record[column : column+1], nil
+	})
+}
+
+// dbHeaderColumn finds the index of the named column in the header row.
+// The names are compared without regard to case or surrounding whitespace (or a leading byte order mark).
+// If there is no column with the name, it returns an error.
+func dbHeaderColumn(header []string, name string) (int, error) {
+	for i, h := range header {
+		if strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")), strings.TrimSpace(name)) {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("No column named '%s' in the header row", name)
+}
+
+// dbLoadHosts reads the specified hosts-format file (e.g. "0.0.0.0 ads.example.com") for the source into the database.
+// Comments, blank lines, and entries that are not domains are skipped. See dbLoadDomains for how the data is loaded.
+func dbLoadHosts(db *sql.DB, path string, s *Source) error {
+	hostsFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer hostsFile.Close()
+
+	scanner := bufio.NewScanner(hostsFile)
+	return dbLoadDomains(db, s, func() ([]string, error) {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+
+		domains, filtered := parseHostsLine(scanner.Text())
+		if filtered > 0 {
+			metricsDomainsSkippedAdd("filtered", s.Label, filtered)
+		}
+
+		return domains, nil
+	})
+}
+
+// dbLoadReplay reads the specified file of query names replayed from a packet capture for the source into the database.
+// Each query name is loaded once however often it was captured. See parseReplayLine for the line format and
+// dbLoadDomains for how the data is loaded.
+func dbLoadReplay(db *sql.DB, path string, s *Source) error {
+	replayFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer replayFile.Close()
+
+	scanner := bufio.NewScanner(replayFile)
+	return dbLoadDomains(db, s, func() ([]string, error) {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+
+		if domain := parseReplayLine(scanner.Text()); domain != "" {
+			return []string{domain}, nil
+		}
+
+		return nil, nil
+	})
+}
+
+// dbLoadList loads the source's inline list of domains into the database.
+// See dbLoadDomains for how the data is loaded.
+func dbLoadList(db *sql.DB, s *Source) error {
+	loaded := false
+	return dbLoadDomains(db, s, func() ([]string, error) {
+		if loaded {
+			return nil, io.EOF
+		}
+		loaded = true
+
+		return s.Domains, nil
+	})
+}
+
+// dbSampleDomains wraps the read function so that a uniform random sample of at most max domains is returned.
+// All of the domains are read on the first call (using reservoir sampling to hold only the sample) and the
+// sample is returned as a single record. The random source is only used by the returned function.
+func dbSampleDomains(read func() ([]string, error), max int, rng *rand.Rand) func() ([]string, error) {
+	sampled := false
+	return func() ([]string, error) {
+		if sampled {
+			return nil, io.EOF
+		}
+		sampled = true
+
+		var seen int
+		sample := make([]string, 0, max)
+		for {
+			domains, err := read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			// each domain replaces a random member of the full sample with probability max/seen
+			for _, domain := range domains {
+				seen++
+				if len(sample) < max {
+					sample = append(sample, domain)
+				} else if i := rng.Intn(seen); i < max {
+					sample[i] = domain
+				}
+			}
+		}
+
+		if seen > max {
+			log.Printf("Sampled %d of %d domains", max, seen)
+		}
+
+		return sample, nil
+	}
+}
+
+// dbLoadDomains loads the domains returned by the read function into the database.
+// The read function returns the domains for each record in turn, and io.EOF once all records have been read.
+// The data is associated with the source's label to provide a means for independently refreshing if multiple sources are loaded.
+// The source's query types are stored with each domain; if there are none, the global query types are used.
+// If data with the label already exist in the database, it will be dropped prior to loading the new set unless merging.
+// When merging, only domains not already present for the label are inserted and the existing data is retained.
+// If the source has a maximum number of domains, a random sample of that many domains is loaded.
+// Once the database holds dbMaxTotalDomains domains (if non-zero), the remaining domains of the source are skipped.
+// If the data cannot be loaded, it returns the error encountered and the caller decides whether it is fatal.
+func dbLoadDomains(db *sql.DB, s *Source, read func() ([]string, error)) error {
+	label := s.Label
+	types := strings.Join(s.Types, ",")
+	merge := s.LoadMode == "merge"
+	if s.MaxDomains > 0 {
+		read = dbSampleDomains(read, s.MaxDomains, newRand())
+	}
+
+	// validate connection to database is still valid
+	err := db.Ping()
+	if err != nil {
+		return err
+	}
+
 	// if there's an error loading the data, rollback to a clean state
 	// if the transaction was committed successfully, the rollback will be a noop
 	tx, err := db.Begin()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer tx.Rollback()
 
+	// remove any data previously associated with the label first
+	// as part of the transaction, the existing data is preserved if the load fails
+	if !merge {
+		err = dbPurgeData(tx, label)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the room left under the total cap is that after the label's existing data (if any) has been purged
+	var room int
+	capped := dbMaxTotalDomains > 0
+	if capped {
+		var numRows int
+		err = tx.QueryRow("SELECT COUNT(*) FROM Domains").Scan(&numRows)
+		if err != nil {
+			return err
+		}
+		if numRows < dbMaxTotalDomains {
+			room = dbMaxTotalDomains - numRows
+		}
+	}
+
 	// be sure the statement is released when done to avoid leaking resources
-	statement, err := tx.Prepare("INSERT INTO Domains(Domain, Label) VALUES(?, ?)")
+	statement, err := tx.Prepare("INSERT OR IGNORE INTO Domains(Domain, Label, Types) VALUES(?, ?, ?)")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer statement.Close()
 
-	reader := csv.NewReader(csvFile)
 	for {
-		record, err := reader.Read()
+		domains, err := read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
-		_, err = statement.Exec(record[column], label)
-		if err != nil {
-			log.Print(err)
-			continue
+		// skipped domains are counted by reason so a change in a source's format is noticeable
+		for _, domain := range domains {
+			if !validDomain(domain) {
+				metricsDomainsSkipped("invalid-hostname", label)
+				continue
+			}
+			if capped && room <= 0 {
+				// logged only for the first domain skipped
+				if room == 0 {
+					log.Printf("Total domains limit (%d) reached; skipping the remaining domains of source '%s'", dbMaxTotalDomains, label)
+					room--
+				}
+				metricsDomainsSkipped("limit", label)
+				continue
+			}
+
+			response, err := statement.Exec(domain, label, types)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+
+			numRows, _ := response.RowsAffected()
+			if numRows == 0 {
+				metricsDomainsSkipped("duplicate", label)
+			} else if capped {
+				room--
+			}
 		}
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		log.Fatal(err)
-	}
+	return tx.Commit()
 }
 
-// dbPurgeData deletes the data associated with the provided label from the database.
+// dbPurgeData deletes the data associated with the provided label from the database as part of the transaction.
 // It is not an error if no rows match the label.
-func dbPurgeData(db *sql.DB, label string) {
-	// validate connection to database is still valid
-	err := db.Ping()
+// If the data cannot be deleted, it returns the error encountered.
+func dbPurgeData(tx *sql.Tx, label string) error {
+	statement, err := tx.Prepare("DELETE FROM Domains WHERE Label=?")
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	statement, err := db.Prepare("DELETE FROM Domains WHERE Label=?")
-	if err != nil {
-		log.Fatal(err)
-		return
+		return err
 	}
+	defer statement.Close()
 
 	response, err := statement.Exec(label)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	numRows, err := response.RowsAffected()
+	numRows, _ := response.RowsAffected()
 	log.Printf("Deleted %d rows for label '%s'", numRows, label)
+
+	return nil
 }
 
 // dbCountRows returns the number of rows found in the Domains table.
 // It ignores the source label and simply returns the number available for use.
-// It is a fatal error if it is unable to access the database or query the Domains table.
-func dbCountRows(db *sql.DB) int {
+// If it is unable to access the database or query the Domains table, it returns the error encountered.
+func dbCountRows(db *sql.DB) (int, error) {
 	// validate connection to database is still valid
 	err := db.Ping()
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 
 	statement := `SELECT COUNT(*) FROM Domains`
 	var numRows int
 	err = db.QueryRow(statement).Scan(&numRows)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 
 	metricsDnsNoiseDomains(float64(numRows))
 
-	return numRows
+	return numRows, nil
+}
+
+// dbCountLabel returns the number of rows found in the Domains table associated with the label.
+// If it is unable to access the database or query the Domains table, it returns the error encountered.
+func dbCountLabel(db *sql.DB, label string) (int, error) {
+	var numRows int
+	err := db.QueryRow("SELECT COUNT(*) FROM Domains WHERE Label=?", label).Scan(&numRows)
+	if err != nil {
+		return 0, err
+	}
+
+	return numRows, nil
 }
 
-// dbGetRandomDomain fetches a random domain from the database.
+// dbGetRandomDomain fetches a random domain from the database along with the label and query types of its source.
+// If the label is not empty, the domain is fetched from only the rows associated with the label.
+// The query types are empty if the source did not declare its own types.
 // If it is unable to fetch a domain, it will return an error and the domain will be empty
-func dbGetRandomDomain(db *sql.DB) (string, error) {
+func dbGetRandomDomain(db *sql.DB, rng *rand.Rand, label string) (string, string, []string, error) {
 	// validate connection to database is still valid
 	err := db.Ping()
 	if err != nil {
 		log.Print(err)
-		return "", err
+		return "", "", nil, err
+	}
+
+	// the span of row ids is found with the indexes without scanning any rows
+	// sqlite only optimizes a lone MIN() or MAX(), hence the separate subqueries
+	var minId, maxId sql.NullInt64
+	if label == "" {
+		err = db.QueryRow("SELECT (SELECT MIN(DomainId) FROM Domains), (SELECT MAX(DomainId) FROM Domains)").Scan(&minId, &maxId)
+	} else {
+		err = db.QueryRow("SELECT (SELECT MIN(DomainId) FROM Domains WHERE Label=$1), (SELECT MAX(DomainId) FROM Domains WHERE Label=$1)", label).Scan(&minId, &maxId)
+	}
+	if err != nil {
+		log.Print(err)
+		return "", "", nil, err
+	}
+	if !minId.Valid {
+		return "", "", nil, fmt.Errorf("No domains available in database")
+	}
+
+	var domain, source, types string
+	span := maxId.Int64 - minId.Int64 + 1
+	if span >= dbIndexedRows {
+		// for a large table, the first row at or after a random row id is located directly with the primary key index
+		// rows following a gap in the ids (from deleted rows) are somewhat more likely to be selected
+		id := minId.Int64 + rng.Int63n(span)
+		if label == "" {
+			err = db.QueryRow("SELECT Domain, Label, Types FROM Domains WHERE DomainId>=$1 ORDER BY DomainId LIMIT 1", id).Scan(&domain, &source, &types)
+		} else {
+			err = db.QueryRow("SELECT Domain, Label, Types FROM Domains WHERE Label=$1 AND DomainId>=$2 ORDER BY DomainId LIMIT 1", label, id).Scan(&domain, &source, &types)
+		}
+		if err != nil {
+			log.Print(err)
+			return "", "", nil, err
+		}
+
+		return dbSplitTypes(domain, source, types)
 	}
 
 	// There may be a large number of rows in the database which don't perform well
 	// with the simpler queries using the ORDER BY RANDOM() as that results in table scans.
-	// Selecting a random OFFSET within the table performs faster for large tables.
-	numRows := dbCountRows(db)
-	offset := rand.Intn(numRows)
+	// Selecting a random OFFSET within a smaller table is uniform and fast enough.
+	var numRows int
+	if label == "" {
+		numRows, err = dbCountRows(db)
+	} else {
+		numRows, err = dbCountLabel(db, label)
+	}
+	if err != nil {
+		log.Print(err)
+		return "", "", nil, err
+	}
+	if numRows == 0 {
+		return "", "", nil, fmt.Errorf("No domains available in database")
+	}
+	offset := rng.Intn(numRows)
 
-	var domain string
-	err = db.QueryRow("SELECT Domain FROM Domains LIMIT 1 OFFSET $1", offset).Scan(&domain)
+	if label == "" {
+		err = db.QueryRow("SELECT Domain, Label, Types FROM Domains LIMIT 1 OFFSET $1", offset).Scan(&domain, &source, &types)
+	} else {
+		err = db.QueryRow("SELECT Domain, Label, Types FROM Domains WHERE Label=$1 LIMIT 1 OFFSET $2", label, offset).Scan(&domain, &source, &types)
+	}
 	if err != nil {
 		log.Print(err)
-		return "", err
+		return "", "", nil, err
+	}
+
+	return dbSplitTypes(domain, source, types)
+}
+
+// dbGetDomainIds returns the row ids of all of the domains in the database.
+// If it is unable to query the Domains table, it returns the error encountered.
+func dbGetDomainIds(db *sql.DB) ([]int64, error) {
+	rows, err := db.Query("SELECT DomainId FROM Domains")
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// dbGetDomain fetches the domain with the row id from the database along with the label and query types of its source.
+// If the row no longer exists (e.g. it was pruned or purged by a refresh), it returns sql.ErrNoRows.
+func dbGetDomain(db *sql.DB, id int64) (string, string, []string, error) {
+	var domain, label, types string
+	err := db.QueryRow("SELECT Domain, Label, Types FROM Domains WHERE DomainId=?", id).Scan(&domain, &label, &types)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return dbSplitTypes(domain, label, types)
+}
+
+// dbSplitTypes returns the domain and label with the comma-separated query types split out.
+// The query types are empty if the source did not declare its own types.
+func dbSplitTypes(domain, label, types string) (string, string, []string, error) {
+	if types == "" {
+		return domain, label, nil, nil
+	}
+
+	return domain, label, strings.Split(types, ","), nil
+}
+
+// dbVacuum rebuilds the database file to reclaim the space left by deleted rows.
+// It requires exclusive access to the database, so concurrent operations wait (up to the busy timeout) until it completes.
+// If the database cannot be vacuumed, it returns the error encountered.
+func dbVacuum(db *sql.DB) error {
+	start := time.Now()
+	_, err := db.Exec("VACUUM")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Vacuumed database in %v", time.Since(start))
+	return nil
+}
+
+// dbOptimize updates the query planner statistics if sqlite determines they are stale (e.g. after a source is reloaded).
+// If the database cannot be optimized, it returns the error encountered.
+func dbOptimize(db *sql.DB) error {
+	_, err := db.Exec("PRAGMA optimize")
+	return err
+}
+
+// dbRecordResult tallies the result of looking up the domain as either a success or a failure.
+// The tally is kept for every row of the domain, regardless of the source label.
+// If the result cannot be recorded, it returns the error encountered.
+func dbRecordResult(db *sql.DB, domain string, resolved bool) error {
+	statement := `UPDATE Domains SET Failures=Failures+1 WHERE Domain=?`
+	if resolved {
+		statement = `UPDATE Domains SET Successes=Successes+1 WHERE Domain=?`
+	}
+
+	_, err := db.Exec(statement, domain)
+	return err
+}
+
+// dbGetResults returns the tally of successful and failed lookups of the domain.
+// If it is unable to query the Domains table, it returns the error encountered.
+func dbGetResults(db *sql.DB, domain string) (int, int, error) {
+	var successes, failures int
+	err := db.QueryRow("SELECT IFNULL(MAX(Successes), 0), IFNULL(MAX(Failures), 0) FROM Domains WHERE Domain=?", domain).Scan(&successes, &failures)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return successes, failures, nil
+}
+
+// dbPruneDomain deletes the domain from the database if it has at least maxFailures failed lookups and no successful ones.
+// If the domain cannot be deleted, it returns the error encountered.
+func dbPruneDomain(db *sql.DB, domain string, maxFailures int) error {
+	response, err := db.Exec("DELETE FROM Domains WHERE Domain=? AND Successes=0 AND Failures>=?", domain, maxFailures)
+	if err != nil {
+		return err
+	}
+
+	numRows, _ := response.RowsAffected()
+	if numRows > 0 {
+		log.Printf("Pruned domain '%s' after %d failed lookups", domain, maxFailures)
+	}
+
+	return nil
+}
+
+// dbExportCSV writes all of the domains in the database to the specified CSV file.
+// Each record contains the domain and the label of the source it was loaded from.
+// If the data cannot be exported, it returns the error encountered.
+func dbExportCSV(db *sql.DB, path string) error {
+	// validate connection to database is still valid
+	err := db.Ping()
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query("SELECT Domain, Label FROM Domains ORDER BY DomainId")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	csvFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer csvFile.Close()
+
+	writer := csv.NewWriter(csvFile)
+	var numRows int
+	for rows.Next() {
+		var domain, label string
+		err = rows.Scan(&domain, &label)
+		if err != nil {
+			return err
+		}
+
+		err = writer.Write([]string{domain, label})
+		if err != nil {
+			return err
+		}
+		numRows++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	writer.Flush()
+	if err = writer.Error(); err != nil {
+		return err
+	}
+
+	log.Printf("Exported %d rows to '%s'", numRows, path)
 
-	return domain, nil
+	return csvFile.Close()
 }
@@ -0,0 +1,57 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMigrateSchema checks that a reused database created with the original schema gains the columns added since.
+func TestMigrateSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns-noise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := dbOpen(filepath.Join(dir, "dns-noise.db"))
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE Domains ("DomainId" INTEGER PRIMARY KEY AUTOINCREMENT, "Domain" TEXT NOT NULL, "Label" TEXT NOT NULL);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO Domains (Domain, Label) VALUES ('example.com', 'source1')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbMigrateSchema(db)
+	// migrating an up to date database leaves it as is
+	dbMigrateSchema(db)
+
+	err = dbRecordResult(db, "example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	successes, failures, err := dbGetResults(db, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if successes != 0 || failures != 1 {
+		t.Errorf("results are %d/%d; want 0/1", successes, failures)
+	}
+
+	domain, label, types, err := dbGetDomain(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain != "example.com" || label != "source1" || len(types) != 0 {
+		t.Errorf("domain is '%s' '%s' %v; want 'example.com' 'source1' []", domain, label, types)
+	}
+}
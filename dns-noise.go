@@ -5,113 +5,609 @@
 package main
 
 import (
+	"context"
 	crypto_rand "crypto/rand"
+	"database/sql"
 	"encoding/binary"
+	"fmt"
 	"log"
 	math_rand "math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-// Initializer for rand
-// Generates a better seed value than simply relying on a time value
-func init() {
+// randSeeds generates the seeds of the random sources if a deterministic seed is in use (see newRand).
+// If nil, each random source is seeded from crypto/rand instead.
+var randSeeds *math_rand.Rand
+var randSeedsMutex sync.Mutex
+
+// seedRandom initializes the seed for the random sources.
+// If a seed was explicitly passed on the command line, it is used as-is so that a run can be reproduced.
+// This is intended for testing only as it makes the noise sequence predictable.
+// Otherwise, each random source is seeded with a better seed value than simply relying on a time value.
+func seedRandom(flags *Flags) {
+	if isFlagPassed("seed") {
+		log.Printf("Using deterministic seed %d; for testing only", flags.Seed)
+		randSeeds = math_rand.New(math_rand.NewSource(flags.Seed))
+	}
+}
+
+// newRand creates a random source for the exclusive use of its caller, so the callers don't contend for the lock of the
+// package-global source. A *rand.Rand is not safe for concurrent use, so it must not be shared between goroutines.
+// If a deterministic seed is in use, the source's seed is derived from it; otherwise it is read from crypto/rand.
+func newRand() *math_rand.Rand {
+	randSeedsMutex.Lock()
+	defer randSeedsMutex.Unlock()
+
+	if randSeeds != nil {
+		return math_rand.New(math_rand.NewSource(randSeeds.Int63()))
+	}
+
 	var b [8]byte
 	_, err := crypto_rand.Read(b[:])
 	if err != nil {
+		log.Print(err.Error())
 	}
 
-	math_rand.Seed(int64(binary.LittleEndian.Uint64(b[:])))
+	return math_rand.New(math_rand.NewSource(int64(binary.LittleEndian.Uint64(b[:]))))
 }
 
 func main() {
 	flags := loadFlags()
+	seedRandom(flags)
 	conf := loadConfig(flags)
+	logConfig(conf.LogOutput)
+	dbConfig(&conf.Noise)
+
+	// check the sources (and pihole) are usable and exit with the result
+	if flags.Validate {
+		outInterfaceConfig(conf.OutInterface)
+		fetchClientConfig(conf.Proxy, conf.Insecure)
+		piholeClientConfig(&conf.Pihole)
+		if !validateRun(conf) {
+			os.Exit(1)
+		}
+		return
+	}
 
-	dnsServerConfig(conf.NameServers)
+	// export the current domain database and exit
+	if flags.Command == "export" {
+		db := dbOpen(conf.Noise.DbPath)
+		err := dbExportCSV(db, flags.ExportPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	outInterfaceConfig(conf.OutInterface)
+	client := newDnsClient(dnsServerConfig(conf.NameServers, conf.DuplicateNameServers), &conf.Noise, &conf.Ecs)
+	if conf.Noise.SelfTestDomain != "" {
+		failed := client.selfTest(conf.Noise.SelfTestDomain)
+		if failed > 0 && conf.Noise.SelfTestFatal {
+			log.Fatalf("%d of %d DNS servers failed the self-test", failed, len(client.Servers))
+		}
+	}
+	dnsBreakerConfig(&conf.Noise)
+	dnsQueryLogConfig(&conf.QueryLog)
+	fetchClientConfig(conf.Proxy, conf.Insecure)
+	piholeClientConfig(&conf.Pihole)
+	activity := activityConfig(conf)
+	recentCacheConfig(&conf.Noise)
+	answerCacheConfig(&conf.Noise)
+	sourceWeightsConfig(conf.Sources)
+	noiseProfilesConfig(conf, flags.Profile)
+	profileConfig(&conf.Noise)
+	coverConfig(conf.CoverSets, &conf.Noise, activityPihole(activity))
 	metricsConfig(&conf.Metrics)
+	if flags.Status {
+		go statusLine()
+	}
+
+	makeNoise(conf, client, activity, flags.ReuseDatabase, refreshLabels(conf.Sources, flags.RefreshLabels), flags.Once)
+
+	// only reached for a run with a fixed number of queries, which is too short-lived to be scraped
+	metricsPush(&conf.Metrics)
+}
 
-	makeNoise(conf, flags.ReuseDatabase)
+// logConfig sets the destination for the log output.
+// The output may be "stderr" (the default), "syslog", or the path of a file which the log output is appended to.
+// It is a fatal error if the destination cannot be opened.
+func logConfig(output string) {
+	switch output {
+	case "", "stderr":
+		return
+	case "syslog":
+		w, err := syslogWriter()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// syslog applies its own timestamps
+		log.SetFlags(0)
+		log.SetOutput(w)
+	default:
+		logFile, err := os.OpenFile(output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.SetOutput(logFile)
+	}
 }
 
-func makeNoise(conf *Config, reuseDb bool) {
+// makeNoise loads the noise domains and issues the noise queries using the DNS client.
+// If reusing the database, only the sources with the refresh labels (if any) are loaded; the others keep their existing data.
+// If once is non-zero, it returns after that many noise queries have been issued (for scheduled runs, e.g. cron).
+// Otherwise it runs indefinitely.
+func makeNoise(conf *Config, client *DnsClient, activity *ActivityRate, reuseDb bool, refresh map[string]bool, once int) {
 	// If reusing existing DB, skip the fetch and data import
 	// Note that this flag only impacts the *initial* fetch & data import cycle
 	// The database will still be refreshed every RefreshPeriod unless that is also disabled
 	db := dbOpen(conf.Noise.DbPath)
+	defer db.Close()
+	var sources []*Source
+	for i := range conf.Sources {
+		if !reuseDb || refresh[conf.Sources[i].Label] {
+			sources = append(sources, &conf.Sources[i])
+		}
+	}
 	if !reuseDb {
 		dbCreateSchema(db)
+	} else {
+		dbMigrateSchema(db)
+		if len(sources) > 0 {
+			log.Printf("Reloading %d sources on start", len(sources))
+		}
+	}
 
-		for _, s := range conf.Sources {
-			sourceFile := fetchDomains(s.Url)
-			dbLoadCSV(db, sourceFile.Name(), s.Label, s.Column)
+	// the downloads are made concurrently but the imports are serialized to avoid lock contention
+	sourcePaths, err := fetchSources(sources, conf.Noise.FetchPar, conf.Noise.Stagger.Duration())
+	if err != nil {
+		// the sources that were fetched are discarded along with the failed ones
+		for _, sourcePath := range sourcePaths {
+			if sourcePath != "" {
+				os.Remove(sourcePath)
+			}
 		}
+		log.Fatal(err)
 	}
 
-	// main loop
-	for {
-		// periodically check to see if sources need to be refreshed
-		refreshSources(db, conf.Sources)
+	// a source which can't be loaded (e.g. malformed data) is left without any domains rather than stopping the others
+	for i, sourcePath := range sourcePaths {
+		err = loadSource(db, sourcePath, sources[i], conf.Noise.WarnDomains)
+		if err != nil {
+			log.Printf("Unable to load domains source '%s': %v", sources[i].Label, err)
+		}
+		if sourcePath != "" {
+			os.Remove(sourcePath)
+		}
+	}
+	logSourcesSummary(db, conf.Sources)
+
+	// sources are refreshed in the background on their own schedules
+	// a run that only issues a fixed number of queries will be gone before any refresh is due
+	if once == 0 {
+		refreshSources(db, conf.Sources, conf.Noise.WarnDomains, conf.Noise.MinRefresh.Duration())
+	}
+
+	// the context is threaded through the query path so in-flight queries can be interrupted
+	// on a shutdown signal no further queries are started, and those in flight are given the drain timeout to complete
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := shutdownSignal(cancel, conf.Noise.DrainTimeout.Duration())
+	vacuumed := time.Now()
+	rng := newRand()
 
+	// main loop
+	for i := 0; once == 0 || i < once; i++ {
 		// sleep between calls to moderate the query rate
-		time.Sleep(calcSleepPeriod(conf))
+		sleepPeriod := calcSleepPeriod(conf, activity, rng)
+		metricsDnsSleepPeriod(sleepPeriod)
+		select {
+		case <-time.After(sleepPeriod):
+		case <-done:
+			log.Println("Stopped issuing noise queries")
+			return
+		}
+
+		// the vacuum is run between queries so it never locks out a selection
+		if conf.Noise.VacuumPeriod > 0 && time.Since(vacuumed) >= conf.Noise.VacuumPeriod.Duration() {
+			err := dbVacuum(db)
+			if err != nil {
+				log.Printf("Unable to vacuum database: %v", err)
+			}
+			vacuumed = time.Now()
+		}
+
+		// a fraction of the periods are left idle, extending the gap until the next query
+		if conf.Noise.IdleProb > 0 && rng.Float64() < conf.Noise.IdleProb {
+			i--
+			continue
+		}
+
+		// a fraction of the queries are CHAOS class server identification queries instead
+		if conf.Noise.ChaosRate > 0 && rng.Float64() < conf.Noise.ChaosRate {
+			client.chaosLookup(ctx)
+			continue
+		}
+
+		// a percentage of the queries are made for the decoys of an active cover set instead
+		var randomDomain, label string
+		var types []string
+		var err error
+		cover := false
+		if conf.Noise.CoverPct > 0 && rng.Intn(100) < conf.Noise.CoverPct {
+			randomDomain, cover = coverDomain(rng)
+		}
 
 		// fetch a random domain and issue a DNS query
-		randomDomain, err := dbGetRandomDomain(db)
+		// sources may declare their own query types; otherwise the global ipv4/ipv6 settings apply
+		// in the sweep selection, every domain is selected in turn so none of them are passed over
+		switch {
+		case cover:
+			// the decoys are not in the database, so there is nothing to select
+		case conf.Noise.Selection == "sweep":
+			randomDomain, label, types, err = sweep.selectDomain(db, rng)
+		default:
+			randomDomain, label, types, err = selectRandomDomain(db, rng, conf.Noise.MaxTldPct, conf.Noise.Adaptive)
+		}
 		if err != nil {
 			log.Print(err)
 		} else {
-			if conf.Noise.IPv6 {
-				dnsLookup(randomDomain, "AAAA")
+			if len(types) == 0 {
+				types = dualStackTypes(rng, noiseTypes(&conf.Noise), conf.Noise.DualStackProb)
+				if trafficProfile != nil {
+					if t := trafficProfile.sampleType(rng); t != "" {
+						types = []string{t}
+					}
+				}
 			}
-			if conf.Noise.IPv4 {
-				dnsLookup(randomDomain, "A")
+
+			// a percentage of the queries are made for synthetic (nonexistent) domains instead
+			synthetic := !cover && rng.Intn(100) < conf.Noise.SyntheticPct
+			mail := false
+			if synthetic {
+				randomDomain = syntheticDomain(rng, conf.Noise.SyntheticTlds)
+			} else if !cover && rng.Intn(100) < conf.Noise.MailPct {
+				mail = true
+				// and a percentage are made for the mail authentication records of the domain
+				randomDomain = mailDomain(rng, randomDomain)
+				types = []string{"TXT"}
+			}
+
+			// the queries for a source's domains (including their mail records) are counted by the source's label
+			if label != "" && !synthetic {
+				metricsDnsQueriesBySource(label)
+			}
+
+			// the mail records are often missing for domains that resolve, so they don't count towards the adaptive tally
+			resolved := issueQueries(ctx, client, randomDomain, types, conf.Noise.Concurrent)
+			if conf.Noise.Adaptive && !synthetic && !cover && !mail && ctx.Err() == nil {
+				recordResult(db, randomDomain, resolved, conf.Noise.PruneFailures)
 			}
 		}
 	}
 }
 
-// calcSleepPeriod determines an appropriate sleep duration between noise queries.
-// If a pihole is properly configured, it will use a percentage of the live traffic rate as the basis.
-// The pihole activity rate will be adjusted to fall within the min/max period if necessary.
-// If a pihole is not configured, a random value between the min and max period will be generated.
-// For additional obfuscation, a random value between 0-10% of the raw sleep period for each call will be added.
-func calcSleepPeriod(c *Config) time.Duration {
-	var sleepPeriod time.Duration
+// refreshLabels parses the comma-separated labels of the sources to be reloaded at startup.
+// It is a fatal error if a label does not match any of the sources.
+func refreshLabels(sources []Source, labels string) map[string]bool {
+	refresh := make(map[string]bool)
+	if labels == "" {
+		return refresh
+	}
 
-	if c.Pihole.Enabled {
-		//		if time.Since(c.Pihole.Timestamp) > c.Pihole.Refresh {
-		if time.Since(c.Pihole.Timestamp) > c.Pihole.Refresh.Duration() {
-			if c.Pihole.Timestamp.IsZero() {
-				log.Println("Initialized pihole timestamp")
-				c.Pihole.Timestamp = time.Now()
-			}
+	known := make(map[string]bool)
+	for _, s := range sources {
+		known[s.Label] = true
+	}
+	for _, label := range strings.Split(labels, ",") {
+		label = strings.TrimSpace(label)
+		if !known[label] {
+			log.Fatalf("No source with the label '%s' to refresh on start", label)
+		}
+		refresh[label] = true
+	}
 
-			// if no activity, an error will be returned
-			numQueries, err := piholeFetchActivity(&c.Pihole)
-			if err != nil {
-				c.Pihole.SleepPeriod = time.Duration(0)
-			} else {
-				c.Pihole.SleepPeriod = time.Duration(int64(c.Pihole.ActivityPeriod.Duration()) * int64(c.Pihole.NoisePercentage) / int64(numQueries))
-			}
-			metricsDnsPiholeRate(float64(numQueries) / c.Pihole.ActivityPeriod.Duration().Seconds())
+	return refresh
+}
+
+// shutdownSignal watches for a shutdown signal (SIGINT or SIGTERM).
+// On the first signal, the returned channel is closed so no new queries are started, and cancel is called once the
+// drain timeout expires to interrupt any queries still in flight. A second signal terminates the process immediately.
+func shutdownSignal(cancel context.CancelFunc, drain time.Duration) <-chan struct{} {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		s := <-sig
+		signal.Stop(sig)
+		log.Printf("Received %v; draining in-flight queries for up to %v", s, drain)
+		close(done)
+		time.AfterFunc(drain, cancel)
+	}()
+
+	return done
+}
+
+// validateRun checks that every source can be fetched and yields a non-empty set of domains, and that the pihole
+// (if enabled) is accessible. The sources are loaded into a scratch database so the noise database is untouched.
+// It prints a pass/fail report and returns whether all of the checks passed.
+func validateRun(conf *Config) bool {
+	passed := true
+	report := func(name string, err error) {
+		if err != nil {
+			passed = false
+			fmt.Printf("FAIL %s: %v\n", name, err)
+		} else {
+			fmt.Printf("PASS %s\n", name)
+		}
+	}
+
+	dbPath := filepath.Join(os.TempDir(), "dns-noise-validate.db")
+	db := dbOpen(dbPath)
+	defer os.Remove(dbPath)
+	defer db.Close()
+	dbCreateSchema(db)
 
-			// if the interval time calculate by pihole activity exceeds limits, then cap appropriately
-			if c.Pihole.SleepPeriod > c.Noise.MaxPeriod.Duration() {
-				c.Pihole.SleepPeriod = c.Noise.MaxPeriod.Duration()
-			} else if c.Pihole.SleepPeriod < c.Noise.MinPeriod.Duration() {
-				c.Pihole.SleepPeriod = c.Noise.MinPeriod.Duration()
+	for i := range conf.Sources {
+		s := &conf.Sources[i]
+		sourcePath, err := fetchSource(s)
+		if err == nil {
+			err = loadSource(db, sourcePath, s, 0)
+			if sourcePath != "" {
+				os.Remove(sourcePath)
 			}
+		}
+
+		var numRows int
+		if err == nil {
+			numRows, err = dbCountLabel(db, s.Label)
+		}
+		if err == nil && numRows == 0 {
+			err = fmt.Errorf("No domains found")
+		}
+
+		report(fmt.Sprintf("source '%s' (%d domains)", s.Label, numRows), err)
+	}
+
+	if conf.Pihole.Enabled {
+		_, err := piholeFetchActivity(&conf.Pihole)
+		report(fmt.Sprintf("pihole '%s'", conf.Pihole.Host), err)
+	}
+	if conf.ActivitySource.Enabled {
+		_, err := newWebhookProvider(&conf.ActivitySource).FetchQPS()
+		report(fmt.Sprintf("activity source '%s'", conf.ActivitySource.Url), err)
+	}
+
+	return passed
+}
+
+// noiseTypes returns the query types enabled by the global ipv4/ipv6 settings.
+func noiseTypes(n *Noise) []string {
+	var types []string
+	if n.IPv6 {
+		types = append(types, "AAAA")
+	}
+	if n.IPv4 {
+		types = append(types, "A")
+	}
+
+	return types
+}
+
+// dualStackTypes randomizes the order of the query types and, if there are two (i.e. "A" and "AAAA"), keeps both only
+// with the given probability. Otherwise just one of them is returned, so not every domain is queried for both.
+func dualStackTypes(rng *math_rand.Rand, types []string, probability float64) []string {
+	if len(types) != 2 {
+		return types
+	}
+
+	if rng.Intn(2) == 0 {
+		types[0], types[1] = types[1], types[0]
+	}
+	if rng.Float64() >= probability {
+		return types[:1]
+	}
+
+	return types
+}
+
+// issueQueries performs a dns query for the domain for each of the query types using the DNS client.
+// If concurrent, all of the queries are sent without waiting on the earlier responses (as stub resolvers do
+// for dual-stack lookups). Otherwise each query waits on the previous response.
+// It returns once all of the queries have completed (or been interrupted by the context), reporting whether
+// any of the queries resolved successfully.
+func issueQueries(ctx context.Context, client *DnsClient, domain string, types []string, concurrent bool) bool {
+	resolved := make([]bool, len(types))
+	if !concurrent {
+		for i, t := range types {
+			resolved[i] = client.lookup(ctx, domain, t)
+		}
+	} else {
+		var wg sync.WaitGroup
+		for i, t := range types {
+			wg.Add(1)
+			go func(i int, t string) {
+				defer wg.Done()
+				resolved[i] = client.lookup(ctx, domain, t)
+			}(i, t)
+		}
+		wg.Wait()
+	}
+
+	for _, r := range resolved {
+		if r {
+			return true
+		}
+	}
+
+	return false
+}
+
+// recordResult tallies whether the domain resolved in the database for biasing the future selections.
+// If pruneFailures is non-zero, a domain that has failed that many times without ever resolving is deleted.
+// Errors are logged but otherwise ignored as the tally is only advisory.
+func recordResult(db *sql.DB, domain string, resolved bool, pruneFailures int) {
+	err := dbRecordResult(db, domain, resolved)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	if !resolved && pruneFailures > 0 {
+		err = dbPruneDomain(db, domain, pruneFailures)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// calcSleepPeriod determines an appropriate sleep duration between noise queries.
+// If the activity rate is given (see activityConfig), it will use a percentage of the live traffic rate from its provider
+// as the basis once warmed up. A failed refresh keeps the last good period, up to the failure grace (see activityRefresh).
+// The live activity rate will be adjusted to fall within the min/max period if necessary.
+// On each refresh, the ratio of the realized noise rate to the live traffic rate is exposed as a metric.
+// If subtracting the noise, an estimate of the noise rate is removed from the live activity rate (see subtractNoise).
+// If no provider is configured (or still warming up), a random value between the min and max period will be generated,
+// or sampled from the traffic profile's intervals if one is loaded.
+// If the min and max period are equal, the min period is used as a constant interval.
+// For additional obfuscation, a random value between 0 and the jitter percentage of the raw sleep period will be added.
+// The sleep period is then scaled by the rate multiplier of the current schedule window, if any.
+// The min/max period and the schedule are those of the active noise profile, if any (see noiseProfilePeriods).
+// If the jitter percentage is 0, the raw sleep period is returned unmodified.
+func calcSleepPeriod(c *Config, a *ActivityRate, rng *math_rand.Rand) time.Duration {
+	var sleepPeriod time.Duration
 
-			c.Pihole.Timestamp = time.Now()
+	// the live activity is not used until the warmup period since startup has elapsed
+	var warmedUp bool
+	if a != nil {
+		if a.Started.IsZero() {
+			a.Started = time.Now()
 		}
+		warmedUp = time.Since(a.Started) >= a.Warmup.Duration()
+	}
+
+	if warmedUp && time.Since(a.Timestamp) > a.Refresh.Duration() {
+		activityRefresh(a, &c.Noise)
+	}
 
-		sleepPeriod = c.Pihole.SleepPeriod
+	// the last good period is kept through a failed refresh until the failure grace is exceeded
+	if warmedUp && a.SleepPeriod > 0 && a.Failures <= a.FailureGrace {
+		sleepPeriod = a.SleepPeriod
+	} else if interval, ok := profileInterval(rng); ok {
+		sleepPeriod = interval
 	} else {
-		sleepRange := int64(c.Noise.MaxPeriod.Duration() - c.Noise.MinPeriod.Duration())
-		sleepPeriod = time.Duration(math_rand.Int63n(sleepRange)) + c.Noise.MinPeriod.Duration()
+		// if min and max are equal, the cadence is fixed at the min period (plus jitter)
+		min, max := noiseProfilePeriods(&c.Noise)
+		sleepPeriod = min
+		sleepRange := int64(max - min)
+		if sleepRange > 0 {
+			sleepPeriod += time.Duration(rng.Int63n(sleepRange))
+		}
+	}
+
+	// a multiplier below 1 slows the query rate (a longer sleep) and one above 1 speeds it up
+	sleepPeriod = time.Duration(float64(sleepPeriod) / scheduleMultiplier(noiseProfileSchedule(&c.Schedule), time.Now()))
+
+	// skip the jitter (and the RNG) entirely if disabled or the jitter range is too small to matter
+	jitterRange := sleepPeriod.Milliseconds() * int64(c.Noise.JitterPct) / 100
+	if jitterRange <= 0 {
+		return sleepPeriod
 	}
 
-	sleepDelta := time.Duration(math_rand.Int63n(sleepPeriod.Milliseconds()/10)) * time.Millisecond
+	sleepDelta := time.Duration(rng.Int63n(jitterRange)) * time.Millisecond
 
 	return sleepPeriod + sleepDelta
 }
+
+// profileInterval samples an interval between queries from the traffic profile.
+// It returns false if there is no traffic profile or it has no intervals.
+func profileInterval(rng *math_rand.Rand) (time.Duration, bool) {
+	if trafficProfile == nil {
+		return 0, false
+	}
+
+	return trafficProfile.sampleInterval(rng)
+}
+
+// scheduleMultiplier returns the query rate multiplier of the first schedule window containing the time of day.
+// The time of day is taken in the schedule's timezone. If no window contains the time of day, it returns 1.
+func scheduleMultiplier(s *Schedule, now time.Time) float64 {
+	if s.Location != nil {
+		now = now.In(s.Location)
+	}
+	hour, min, sec := now.Clock()
+	clock := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+
+	for _, w := range s.Windows {
+		start, end := w.Start.Duration(), w.End.Duration()
+		if start <= end && clock >= start && clock < end {
+			return w.Multiplier
+		}
+		// the window spans midnight
+		if start > end && (clock >= start || clock < end) {
+			return w.Multiplier
+		}
+	}
+
+	return 1
+}
+
+// subtractNoise removes an estimate of the noise rate from the live activity rate, which guards against the noise
+// feeding back into its own rate if the provider does not exclude it (e.g. by the pihole's filter).
+// The estimate is the realized noise rate (queries per second) since the previous refresh.
+// At least 1 query per window is always kept, so the correction can only slow the noise and never drive it to the min period.
+// The estimated number of noise queries subtracted over the window is exposed as a metric.
+func subtractNoise(liveRate, noiseRate float64, window time.Duration) float64 {
+	floor := 1 / window.Seconds()
+	estimate := noiseRate
+	if liveRate-estimate < floor {
+		estimate = liveRate - floor
+	}
+	if estimate < 0 {
+		estimate = 0
+	}
+	metricsDnsPiholeCorrection(estimate * window.Seconds())
+
+	return liveRate - estimate
+}
+
+// calcActivityPeriod calculates the sleep period between noise queries from the live activity rate (queries per second).
+// The sleep period is the noise percentage divided by the live activity rate, in seconds.
+// The result is capped to fall within the min/max period. If there is no activity, the min period is returned.
+// It has no side effects and does not consult the provider, the clock, or the RNG.
+func calcActivityPeriod(liveRate float64, percentage int, min, max time.Duration) time.Duration {
+	var period time.Duration
+
+	// the max is checked first to avoid overflowing the duration with a very low rate
+	if liveRate > 0 && percentage > 0 {
+		seconds := float64(percentage) / liveRate
+		if seconds >= max.Seconds() {
+			return max
+		}
+		period = time.Duration(seconds * float64(time.Second))
+	}
+
+	return clampPeriod(period, min, max)
+}
+
+// clampPeriod adjusts the period to fall within the min/max period if necessary.
+// It returns the adjusted period.
+func clampPeriod(period, min, max time.Duration) time.Duration {
+	if period > max {
+		return max
+	}
+	if period < min {
+		return min
+	}
+
+	return period
+}
@@ -0,0 +1,155 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// countingSource is a random source counting how often the RNG draws from it.
+type countingSource struct {
+	rand.Source
+	draws int
+}
+
+func (s *countingSource) Int63() int64 {
+	s.draws++
+	return s.Source.Int63()
+}
+
+// TestSleepPeriodJitter checks that a jitter percentage of 0 returns the base period unmodified without drawing from the
+// RNG, and that any other percentage adds up to that percentage of the base period.
+func TestSleepPeriodJitter(t *testing.T) {
+	tests := []struct {
+		jitter int
+		noise  string
+	}{
+		{0, `{"noise": {"minPeriod": "1s", "maxPeriod": "10s", "jitterPercentage": 0}}`},
+		{10, `{"noise": {"minPeriod": "1s", "maxPeriod": "10s", "jitterPercentage": 10}}`},
+		{50, `{"noise": {"minPeriod": "1s", "maxPeriod": "10s", "jitterPercentage": 50}}`},
+	}
+	for _, test := range tests {
+		c := newConfig()
+		err := json.Unmarshal([]byte(test.noise), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the base period is the last good one from the activity, which isn't refreshed again within the hour
+		a := &ActivityRate{
+			Refresh:     Duration(time.Hour),
+			Provider:    &fakeProvider{},
+			Timestamp:   time.Now(),
+			SleepPeriod: 4 * time.Second,
+		}
+		src := &countingSource{Source: rand.NewSource(1)}
+		rng := rand.New(src)
+
+		for i := 0; i < 20; i++ {
+			period := calcSleepPeriod(c, a, rng)
+			if test.jitter == 0 {
+				if period != 4*time.Second {
+					t.Fatalf("sleep period without jitter is %v; want 4s", period)
+				}
+				continue
+			}
+			max := 4*time.Second + 4*time.Second*time.Duration(test.jitter)/100
+			if period < 4*time.Second || period >= max {
+				t.Fatalf("sleep period with %d%% jitter is %v; want within 4s-%v", test.jitter, period, max)
+			}
+		}
+
+		if test.jitter == 0 && src.draws != 0 {
+			t.Errorf("drew %d times from the RNG without jitter; want none", src.draws)
+		}
+		if test.jitter > 0 && src.draws == 0 {
+			t.Errorf("never drew from the RNG with %d%% jitter", test.jitter)
+		}
+	}
+}
+
+// TestSleepPeriodFixedCadence checks that equal min and max periods issue the queries at that constant interval,
+// and that a zero period is rejected rather than issuing the queries without any pause.
+func TestSleepPeriodFixedCadence(t *testing.T) {
+	c := newConfig()
+	err := json.Unmarshal([]byte(`{"noise": {"minPeriod": "2s", "maxPeriod": "2s", "jitterPercentage": 0}}`), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validateConfig(c)
+	if err != nil {
+		t.Fatalf("validateConfig: %v", err)
+	}
+
+	rng := newRand()
+	for i := 0; i < 10; i++ {
+		if period := calcSleepPeriod(c, nil, rng); period != 2*time.Second {
+			t.Fatalf("sleep period is %v; want 2s", period)
+		}
+	}
+
+	c = newConfig()
+	err = json.Unmarshal([]byte(`{"noise": {"minPeriod": "0s", "maxPeriod": "0s"}}`), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validateConfig(c)
+	if err == nil {
+		t.Error("validateConfig accepted a zero max period")
+	}
+}
+
+// TestCalcActivityPeriod checks the sleep period derived from the live activity rate and its clamping to the min/max period.
+func TestCalcActivityPeriod(t *testing.T) {
+	tests := []struct {
+		name       string
+		liveRate   float64
+		percentage int
+		min, max   time.Duration
+		want       time.Duration
+	}{
+		{"no activity", 0, 10, time.Second, 10 * time.Second, time.Second},
+		{"negative rate", -5, 10, time.Second, 10 * time.Second, time.Second},
+		{"zero percentage", 5, 0, time.Second, 10 * time.Second, time.Second},
+		{"full percentage", 50, 100, time.Second, 10 * time.Second, 2 * time.Second},
+		{"within range", 5, 10, time.Second, 10 * time.Second, 2 * time.Second},
+		{"below min", 1000, 10, time.Second, 10 * time.Second, time.Second},
+		{"above max", 0.5, 10, time.Second, 10 * time.Second, 10 * time.Second},
+		{"min equals max", 5, 10, 3 * time.Second, 3 * time.Second, 3 * time.Second},
+		{"tiny rate", 1e-300, 10, time.Second, 10 * time.Second, 10 * time.Second},
+		{"tiny rate with huge max", 1e-12, 10, time.Second, 1 << 62, 1 << 62},
+	}
+	for _, test := range tests {
+		got := calcActivityPeriod(test.liveRate, test.percentage, test.min, test.max)
+		if got != test.want {
+			t.Errorf("%s: calcActivityPeriod(%v, %d, %v, %v) is %v; want %v", test.name, test.liveRate, test.percentage, test.min, test.max, got, test.want)
+		}
+	}
+}
+
+// TestClampPeriod checks that the period is adjusted to fall within the min/max period.
+func TestClampPeriod(t *testing.T) {
+	tests := []struct {
+		period, min, max time.Duration
+		want             time.Duration
+	}{
+		{500 * time.Millisecond, time.Second, 10 * time.Second, time.Second},
+		{20 * time.Second, time.Second, 10 * time.Second, 10 * time.Second},
+		{5 * time.Second, time.Second, 10 * time.Second, 5 * time.Second},
+		{time.Second, time.Second, 10 * time.Second, time.Second},
+		{10 * time.Second, time.Second, 10 * time.Second, 10 * time.Second},
+		{0, 3 * time.Second, 3 * time.Second, 3 * time.Second},
+		{-time.Second, 0, 10 * time.Second, 0},
+	}
+	for _, test := range tests {
+		got := clampPeriod(test.period, test.min, test.max)
+		if got != test.want {
+			t.Errorf("clampPeriod(%v, %v, %v) is %v; want %v", test.period, test.min, test.max, got, test.want)
+		}
+	}
+}
@@ -5,23 +5,127 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	crypto_rand "crypto/rand"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"github.com/miekg/dns"
 	"log"
+	"math/rand"
 	"net"
-	//	"reflect"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 )
 
-// dnsServers contain the address(es) of the DNS servers to query.
-// The servers specified may be different than the local DNS servers (e.g. piholes).
-var dnsServers []string
+// DnsClient issues the DNS queries against a set of DNS servers.
+// Servers contain the address(es) of the DNS servers to query, which may be different than the local DNS servers (e.g. piholes).
+// RecursionDesired indicates whether the queries are sent with the RD (recursion desired) bit set.
+// FollowCname indicates whether a CNAME answer is followed with a query for its target.
+// TcpRate is the fraction (0.0-1.0) of queries sent over TCP rather than UDP.
+// SystemRate is the fraction (0.0-1.0) of queries sent to a server from the system's resolv.conf rather than the Servers.
+// RetryTruncated indicates whether a truncated UDP response is retried over TCP.
+// MaxAnswers is the maximum number of answer records in a response processed individually (0 is unlimited).
+// DnssecOk indicates whether the queries are sent with the DO (DNSSEC OK) bit set.
+// AllowAny indicates whether 'ANY' is accepted as a query type.
+// SlowQuery is the response time above which a query is counted as slow (0 disables the count).
+// Ecs indicates whether the queries are sent with an EDNS Client Subnet option, for one of the EcsSubnets (if any)
+// or otherwise a random public IPv4 subnet.
+// The number of consecutive queries for which every server failed is tracked to detect a total DNS outage.
+// The client has its own random source as its queries may be issued concurrently (see random).
+type DnsClient struct {
+	// accessed atomically; kept first for 64-bit alignment on 32-bit platforms
+	failures         int64
+	Servers          []string
+	RecursionDesired bool
+	FollowCname      bool
+	TcpRate          float64
+	SystemRate       float64
+	RetryTruncated   bool
+	MaxAnswers       int
+	DnssecOk         bool
+	AllowAny         bool
+	SlowQuery        time.Duration
+	Ecs              bool
+	EcsSubnets       []*net.IPNet
+	client           *dns.Client
+	tcpClient        *dns.Client
+	systemServers    []string
+	systemRead       time.Time
+	systemMutex      sync.Mutex
+	rng              *rand.Rand
+	rngMutex         sync.Mutex
+}
+
+// dnsQueriesSent is the total number of DNS requests sent to the servers (including retries and failovers).
+// It is accessed atomically.
+var dnsQueriesSent int64
+
+// dnsSystemReread is how often the system's resolv.conf is re-read for the servers it lists.
+const dnsSystemReread = 5 * time.Minute
+
+// dnsMaxCnameHops is the maximum number of CNAMEs followed for a lookup to avoid looping on a CNAME cycle.
+const dnsMaxCnameHops = 8
+
+// dnsChaosNames are the server identification names queried in the CHAOS class (see RFC 4892).
+var dnsChaosNames = []string{"version.bind", "hostname.bind", "id.server", "version.server"}
+
+// dnsBreakers tracks the consecutive failures of each DNS server so a repeatedly failing server can be skipped.
+// dnsBreakerFailures is the number of consecutive failures before a server is skipped (0 disables skipping) and
+// dnsBreakerCooldown is how long it is skipped before being tried again.
+var dnsBreakers = make(map[string]*dnsBreaker)
+var dnsBreakersMutex sync.Mutex
+var dnsBreakerFailures int
+var dnsBreakerCooldown time.Duration
+
+// dnsBreaker contains the failure state of a single DNS server.
+type dnsBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// dnsAnswerLog contains the template used for logging each answer record received.
+// If nil, answer records are not logged.
+var dnsAnswerLog *template.Template
 
-// dnsServerConfig sets the IP addresses and port for the set of DNS servers to be queried.
+// dnsQueryFile is the file to which a record of every query is appended, in the dnsQueryFileFormat ("jsonl" or "csv").
+// If nil, the queries are not recorded. The mutex serializes the records of concurrent queries.
+var dnsQueryFile *os.File
+var dnsQueryFileFormat string
+var dnsQueryFileMutex sync.Mutex
+
+// dnsQueryRecord contains the fields of a query recorded in the query file.
+type dnsQueryRecord struct {
+	Time   time.Time `json:"time"`
+	Domain string    `json:"domain"`
+	Type   string    `json:"type"`
+	Server string    `json:"server"`
+	Rcode  string    `json:"rcode"`
+	Rtt    float64   `json:"rttMs"`
+}
+
+// dnsAnswer contains the fields of an answer record made available to the answer log template.
+type dnsAnswer struct {
+	Type   string
+	Name   string
+	Answer string
+	Rcode  string
+	Server string
+}
+
+// dnsServerConfig determines the IP addresses and port for the set of DNS servers to be queried.
 // If a Nameserver struct is provide and valid, the configuration will reflect those settings.
 // If a Nameserver struct is omitted or invalid, it will attempt to establish the configuration based on the system default as defined in /etc/resolv.conf.
-func dnsServerConfig(ns []NameServer) {
+// Duplicate servers are handled according to the duplicates setting (see dnsDedupeServers).
+// It returns the set of host/port strings for the DNS servers.
+func dnsServerConfig(ns []NameServer, duplicates string) []string {
 	var servers []string
 	servers, err := dnsStatedClientConfig(ns)
 	if err != nil {
@@ -32,7 +136,235 @@ func dnsServerConfig(ns []NameServer) {
 		}
 	}
 
-	dnsServers = servers
+	servers = dnsDedupeServers(servers, duplicates)
+
+	// without any servers every lookup would silently be a noop, so treat it as a fatal configuration error
+	if len(servers) == 0 {
+		log.Fatal("No usable DNS servers configured")
+	}
+
+	metricsDnsNameservers(float64(len(servers)))
+
+	return servers
+}
+
+// dnsDedupeServers handles the servers listed more than once (by host/port), e.g. by a copy and paste error.
+// In the "remove" mode, only the first of the duplicates is kept and the others are logged as removed. In the "keep" mode,
+// the duplicates are kept (e.g. to deliberately retry a server on failover). In the "fatal" mode, a duplicate is a fatal error.
+// It returns the servers in their original order.
+func dnsDedupeServers(servers []string, duplicates string) []string {
+	if duplicates == "keep" {
+		return servers
+	}
+
+	var deduped []string
+	seen := make(map[string]bool)
+	for _, s := range servers {
+		if seen[s] {
+			if duplicates == "fatal" {
+				log.Fatalf("Nameserver '%s' is listed more than once", s)
+			}
+			log.Printf("Removed duplicate nameserver '%s'", s)
+			continue
+		}
+		seen[s] = true
+		deduped = append(deduped, s)
+	}
+
+	return deduped
+}
+
+// outDialer is the dialer binding the outbound connections to the configured interface (nil if not configured).
+var outDialer *net.Dialer
+
+// outInterfaceConfig sets up the dialer binding the DNS queries and the source fetches to the named network interface,
+// e.g. for routing the noise out of a VPN or a dedicated interface. An empty interface leaves the routing to the system.
+// It is a fatal error if the interface does not exist or binding is not supported on the platform (only Linux).
+func outInterfaceConfig(iface string) {
+	if iface == "" {
+		return
+	}
+
+	if _, err := net.InterfaceByName(iface); err != nil {
+		log.Fatalf("Invalid outInterface '%s': %v", iface, err)
+	}
+
+	control, err := bindToDevice(iface)
+	if err != nil {
+		log.Fatalf("Invalid outInterface '%s': %v", iface, err)
+	}
+
+	outDialer = &net.Dialer{Control: control}
+	log.Printf("Binding DNS queries and source fetches to interface '%s'", iface)
+}
+
+// newDnsClient creates a client for querying the DNS servers with the query options set in the noise configuration
+// and the EDNS Client Subnet configuration. The ECS subnets are expected to have been validated with the configuration.
+func newDnsClient(servers []string, n *Noise, e *Ecs) *DnsClient {
+	if !n.RecursionDesired {
+		log.Println("Recursion desired disabled; queries sent with the RD bit cleared")
+	}
+
+	var subnets []*net.IPNet
+	for _, s := range e.Subnets {
+		if _, subnet, err := net.ParseCIDR(s); err == nil {
+			subnets = append(subnets, subnet)
+		}
+	}
+
+	client := new(dns.Client)
+	tcpClient := &dns.Client{Net: "tcp"}
+	if outDialer != nil {
+		client.Dialer = outDialer
+		tcpClient.Dialer = outDialer
+	}
+
+	return &DnsClient{
+		Servers:          servers,
+		RecursionDesired: n.RecursionDesired,
+		FollowCname:      n.FollowCname,
+		TcpRate:          n.TcpRate,
+		SystemRate:       n.SystemRate,
+		RetryTruncated:   n.RetryTruncated,
+		MaxAnswers:       n.MaxAnswers,
+		DnssecOk:         n.DnssecOk,
+		AllowAny:         n.AllowAny,
+		SlowQuery:        n.SlowQuery.Duration(),
+		Ecs:              e.Enabled,
+		EcsSubnets:       subnets,
+		client:           client,
+		tcpClient:        tcpClient,
+		rng:              newRand(),
+	}
+}
+
+// dnsBreakerConfig sets the number of consecutive failures after which a DNS server is skipped and for how long.
+// A failure threshold of 0 disables skipping failed servers.
+func dnsBreakerConfig(n *Noise) {
+	dnsBreakerFailures = n.ServerFailures
+	dnsBreakerCooldown = n.ServerCooldown.Duration()
+}
+
+// dnsServerSkipped checks whether the DNS server has failed repeatedly and is still within its cooldown period.
+// Once the cooldown period expires, the server will be tried again; a further failure restarts the cooldown.
+// It returns a bool reflecting whether the server should be skipped or not.
+func dnsServerSkipped(server string) bool {
+	dnsBreakersMutex.Lock()
+	defer dnsBreakersMutex.Unlock()
+
+	b, ok := dnsBreakers[server]
+	return ok && time.Now().Before(b.openUntil)
+}
+
+// dnsServerResult records the result of a query against the DNS server for tracking consecutive failures.
+func dnsServerResult(server string, success bool) {
+	if dnsBreakerFailures <= 0 {
+		return
+	}
+
+	dnsBreakersMutex.Lock()
+	defer dnsBreakersMutex.Unlock()
+
+	b, ok := dnsBreakers[server]
+	if !ok {
+		b = new(dnsBreaker)
+		dnsBreakers[server] = b
+	}
+
+	if success {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= dnsBreakerFailures {
+		b.openUntil = time.Now().Add(dnsBreakerCooldown)
+		log.Printf("Skipping DNS server '%s' for %v after %d consecutive failures", server, dnsBreakerCooldown, b.failures)
+	}
+}
+
+// dnsQueryLogConfig sets up the logging of individual answer records received from the DNS servers.
+// If the query log is disabled or the format cannot be parsed, answer records will not be logged.
+// Errors and non-success response codes are logged independently of this setting.
+// The recording of every query to the query file is set up regardless of whether the answer records are logged.
+func dnsQueryLogConfig(q *QueryLog) {
+	if q != nil && q.File != "" {
+		dnsQueryFileConfig(q.File, q.FileFormat)
+	}
+
+	if q == nil || !q.Enabled {
+		log.Println("Answer logging disabled; omitting")
+		return
+	}
+
+	format := q.Format
+	if format == "" {
+		format = "{{.Type}}: {{.Name}}->{{.Answer}}; {{.Rcode}}"
+	}
+
+	t, err := template.New("answer").Parse(format)
+	if err != nil {
+		log.Printf("Unable to parse answer log format '%s': %v", format, err)
+		return
+	}
+
+	dnsAnswerLog = t
+}
+
+// dnsQueryFileConfig opens the file to which a record of every query is appended.
+// It is a fatal error if the file cannot be opened.
+func dnsQueryFileConfig(path, format string) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("Unable to open query file '%s': %v", path, err)
+	}
+
+	log.Printf("Recording queries to '%s' (%s)", path, format)
+	dnsQueryFile = file
+	dnsQueryFileFormat = format
+}
+
+// dnsRecordQuery appends a record of the query against the server to the query file (if any).
+// A record which can't be written is logged but otherwise ignored.
+func dnsRecordQuery(q *dns.Msg, server, rcode string, rtt time.Duration) {
+	if dnsQueryFile == nil {
+		return
+	}
+
+	record := dnsQueryRecord{
+		Time:   time.Now(),
+		Domain: strings.TrimSuffix(q.Question[0].Name, "."),
+		Type:   dns.TypeToString[q.Question[0].Qtype],
+		Server: server,
+		Rcode:  rcode,
+		Rtt:    float64(rtt.Microseconds()) / 1000,
+	}
+
+	var line []byte
+	var err error
+	if dnsQueryFileFormat == "csv" {
+		var b bytes.Buffer
+		w := csv.NewWriter(&b)
+		w.Write([]string{record.Time.Format(time.RFC3339Nano), record.Domain, record.Type, record.Server, record.Rcode,
+			strconv.FormatFloat(record.Rtt, 'f', 3, 64)})
+		w.Flush()
+		line, err = b.Bytes(), w.Error()
+	} else {
+		line, err = json.Marshal(record)
+		line = append(line, '\n')
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	dnsQueryFileMutex.Lock()
+	defer dnsQueryFileMutex.Unlock()
+
+	_, err = dnsQueryFile.Write(line)
+	if err != nil {
+		log.Printf("Unable to record query: %v", err)
+	}
 }
 
 // dnsStatedClientConfig sets the IP addresses and port for the set of DNS servers to be queried based on the information in the Nameserver passed in.
@@ -130,15 +462,30 @@ func dnsFormatIP(ipaddr, zone string) (string, error) {
 	return formattedIP, nil
 }
 
-// dnsLookup performs a dns query for the domain and type specified.
-// Supported lookup types include 'A', 'AAAA', 'CNAME', and 'MX'.
+// dnsSupportedType checks whether the query type (e.g. "AAAA") is one supported for lookups.
+// The "ANY" type is only supported if allowAny is set, as most resolvers refuse it (see RFC 8482).
+// It returns a bool reflecting whether the type is supported or not.
+func dnsSupportedType(msgType string, allowAny bool) bool {
+	switch dns.StringToType[msgType] {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeMX, dns.TypeTXT, dns.TypeDNAME, dns.TypeNAPTR:
+		return true
+	case dns.TypeANY:
+		return allowAny
+	default:
+		return false
+	}
+}
+
+// lookup performs a dns query for the domain and type specified.
+// Supported lookup types include 'A', 'AAAA', 'CNAME', 'MX', 'TXT', 'DNAME', and 'NAPTR' (and 'ANY' if allowed).
 // Unrecognized or unhandled lookup types will be defaulted to a 'A' lookup.
-func dnsLookup(domain, msgType string) {
+// If the context is cancelled (or its deadline exceeded), any in-flight query is interrupted and no further servers are tried.
+// If following CNAMEs, the target of a CNAME answer is queried in turn (see followCname).
+// It returns whether a server answered the query with a success (NOERROR) response code.
+// An 'ANY' query refused by the server (NOTIMP or REFUSED) is the expected behavior and is not counted as a failure.
+func (c *DnsClient) lookup(ctx context.Context, domain, msgType string) bool {
 	t := dns.StringToType[msgType]
-	switch t {
-	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeMX:
-		break
-	default:
+	if !dnsSupportedType(msgType, c.AllowAny) {
 		log.Printf("Unexpected query type (%v); defaulting to 'A'", msgType)
 		t = dns.TypeA
 	}
@@ -146,32 +493,469 @@ func dnsLookup(domain, msgType string) {
 	q := new(dns.Msg)
 	q.SetQuestion(dns.Fqdn(domain), t)
 
+	r := c.exchange(ctx, q)
+	if r != nil && (r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError) {
+		answerCache.add(domain, t, responseTtl(r))
+	}
+	if r != nil && t == dns.TypeANY && (r.Rcode == dns.RcodeNotImplemented || r.Rcode == dns.RcodeRefused) {
+		return true
+	}
+	if r == nil || r.Rcode != dns.RcodeSuccess {
+		return false
+	}
+
+	if c.FollowCname {
+		c.followCname(ctx, r, t)
+	}
+
+	return true
+}
+
+// answers is a cache of the expiry of the answers by name and query type, mimicking a caching resolver.
+// A size of 0 disables the cache. It is shared by concurrent lookups, so it is guarded by its mutex.
+type answers struct {
+	mutex   sync.Mutex
+	size    int
+	count   int
+	entries map[string]map[uint16]time.Time
+}
+
+// answerCache contains the expiry of the answers received. A size of 0 disables the cache.
+var answerCache = newAnswers(0)
+
+// newAnswers creates an empty cache of the answers' expiry.
+func newAnswers(size int) *answers {
+	return &answers{
+		size:    size,
+		entries: make(map[string]map[uint16]time.Time),
+	}
+}
+
+// answerCacheConfig sets up the cache of the answers' expiry from the noise configuration.
+func answerCacheConfig(n *Noise) {
+	answerCache = newAnswers(n.AnswerCacheSize)
+}
+
+// add records that the answer for the name and query type expires after the ttl.
+// If the cache is full, the expired answers are removed first; if still full, the answer is not recorded.
+func (a *answers) add(name string, t uint16, ttl time.Duration) {
+	if a.size <= 0 || ttl <= 0 {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if _, ok := a.entries[name][t]; !ok && a.count >= a.size {
+		a.prune()
+		if a.count >= a.size {
+			return
+		}
+	}
+
+	if a.entries[name] == nil {
+		a.entries[name] = make(map[uint16]time.Time)
+	}
+	if _, ok := a.entries[name][t]; !ok {
+		a.count++
+	}
+	a.entries[name][t] = time.Now().Add(ttl)
+}
+
+// prune removes the expired answers. The caller must hold the mutex.
+func (a *answers) prune() {
+	now := time.Now()
+	for name, types := range a.entries {
+		for t, expiry := range types {
+			if now.After(expiry) {
+				delete(types, t)
+				a.count--
+			}
+		}
+		if len(types) == 0 {
+			delete(a.entries, name)
+		}
+	}
+}
+
+// cached checks whether the name has an unexpired answer for any of the query types.
+// If no query types are given (i.e. they're only chosen once the domain is selected), an answer of any type counts.
+// It returns a bool reflecting whether a caching resolver would still answer from its cache or not.
+func (a *answers) cached(name string, types []string) bool {
+	if a.size <= 0 {
+		return false
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	for t, expiry := range a.entries[strings.ToLower(strings.TrimSuffix(name, "."))] {
+		if now.After(expiry) {
+			continue
+		}
+		if len(types) == 0 {
+			return true
+		}
+		for _, qtype := range types {
+			if dns.StringToType[qtype] == t {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// responseTtl returns how long a caching resolver would keep the response: the lowest TTL of the answer records, or
+// for a negative response (no answer records), the lower of the SOA record's TTL and minimum TTL (RFC 2308).
+// It returns 0 if the response has neither answer records nor an SOA record.
+func responseTtl(r *dns.Msg) time.Duration {
+	var ttl uint32
+	found := false
+	for _, rr := range r.Answer {
+		if h := rr.Header(); !found || h.Ttl < ttl {
+			ttl, found = h.Ttl, true
+		}
+	}
+	if found {
+		return time.Duration(ttl) * time.Second
+	}
+
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+
+	return 0
+}
+
+// followCname queries the target of the CNAME chain in the response if the response has no records for the target.
+// The target is queried for the same type if the original query was for an 'A' or 'AAAA' record, otherwise for an 'A' record.
+// The chain is followed until a response includes the target's records, fails, or dnsMaxCnameHops is reached.
+func (c *DnsClient) followCname(ctx context.Context, r *dns.Msg, t uint16) {
+	if t != dns.TypeA && t != dns.TypeAAAA {
+		t = dns.TypeA
+	}
+
+	for hop := 0; hop < dnsMaxCnameHops; hop++ {
+		target := dnsCnameTarget(r, t)
+		if target == "" {
+			return
+		}
+
+		metricsDnsCnameFollow()
+		q := new(dns.Msg)
+		q.SetQuestion(target, t)
+
+		r = c.exchange(ctx, q)
+		if r == nil || r.Rcode != dns.RcodeSuccess {
+			return
+		}
+	}
+}
+
+// dnsCnameTarget walks the CNAME chain in the answer section starting from the question name.
+// It returns the final target of the chain if the answer section has no record of the type for it.
+// If there is no CNAME for the question name, or the target's records are included, it returns an empty string.
+func dnsCnameTarget(r *dns.Msg, t uint16) string {
+	if len(r.Question) == 0 {
+		return ""
+	}
+
+	name := r.Question[0].Name
+	target := ""
+	for range r.Answer {
+		next := ""
+		for _, a := range r.Answer {
+			if cname, ok := a.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next = cname.Target
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+		target = next
+	}
+
+	if target == "" {
+		return ""
+	}
+	for _, a := range r.Answer {
+		if a.Header().Rrtype == t && strings.EqualFold(a.Header().Name, target) {
+			return ""
+		}
+	}
+
+	return target
+}
+
+// chaosLookup performs a TXT query in the CHAOS class for a randomly selected server identification name.
+// It returns whether a server answered the query with a success (NOERROR) response code.
+func (c *DnsClient) chaosLookup(ctx context.Context) bool {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(dnsChaosNames[c.randomIntn(len(dnsChaosNames))]), dns.TypeTXT)
+	q.Question[0].Qclass = dns.ClassCHAOS
+
+	r := c.exchange(ctx, q)
+	return r != nil && r.Rcode == dns.RcodeSuccess
+}
+
+// exchange sends the query message to the DNS servers, failing over to the next server on a connection error.
+// It returns the response from the server that answered, or nil if no server answered (or the context was cancelled).
+// A query for which every server failed is counted as a consecutive failure, and the count is reset on any response.
+func (c *DnsClient) exchange(ctx context.Context, q *dns.Msg) *dns.Msg {
+	q.RecursionDesired = c.RecursionDesired
+	if c.DnssecOk {
+		q.SetEdns0(4096, true)
+	}
+	if c.Ecs {
+		c.setClientSubnet(q)
+	}
+
 	// try each dns server if a connection error is encountered
 	// server response codes (e.g. NXDOMAIN) are *not* considered errors
-	for _, d := range dnsServers {
-		_, err := dnsQuery(q, d)
+	// servers that have failed repeatedly are skipped, unless all of the servers would be skipped
+	servers := c.availableServers()
+	if c.SystemRate > 0 && c.random() < c.SystemRate {
+		servers = append(c.systemServer(), servers...)
+	}
+	for _, d := range servers {
+		// each attempt gets a fresh, unpredictable ID so the noise can't be correlated by ID sequence
+		q.Id = dnsQueryId()
+		r, err := c.query(ctx, q, d)
+		if ctx.Err() != nil {
+			return nil
+		}
+		dnsServerResult(d, err == nil)
 		if err != nil {
 			log.Print(err.Error())
 			continue
 		}
-		break
+
+		atomic.StoreInt64(&c.failures, 0)
+		metricsDnsConsecutiveFailures(0)
+		return r
+	}
+
+	metricsDnsConsecutiveFailures(float64(atomic.AddInt64(&c.failures, 1)))
+	return nil
+}
+
+// setClientSubnet adds an EDNS Client Subnet option to the query, adding an OPT record first if the query has none.
+// The subnet is picked at random from the EcsSubnets, or if there are none, is a random public IPv4 /24 subnet.
+func (c *DnsClient) setClientSubnet(q *dns.Msg) {
+	opt := q.IsEdns0()
+	if opt == nil {
+		q.SetEdns0(4096, false)
+		opt = q.IsEdns0()
+	}
+
+	var subnet *net.IPNet
+	if len(c.EcsSubnets) > 0 {
+		subnet = c.EcsSubnets[c.randomIntn(len(c.EcsSubnets))]
+	} else {
+		subnet = c.randomSubnet()
+	}
+
+	ones, _ := subnet.Mask.Size()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(ones),
+		Address:       subnet.IP,
+	}
+	if subnet.IP.To4() == nil {
+		ecs.Family = 2
+	}
+	opt.Option = append(opt.Option, ecs)
+}
+
+// randomSubnet generates a random IPv4 /24 subnet, re-rolling any which are not public (e.g. private or reserved networks).
+func (c *DnsClient) randomSubnet() *net.IPNet {
+	for {
+		ip := net.IPv4(byte(c.randomIntn(256)), byte(c.randomIntn(256)), byte(c.randomIntn(256)), 0).To4()
+		if dnsPublicIPv4(ip) {
+			return &net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)}
+		}
+	}
+}
+
+// dnsPublicIPv4 checks whether the IPv4 address is a public unicast address, i.e. not in a private, shared, loopback,
+// link-local, multicast, or reserved network.
+func dnsPublicIPv4(ip net.IP) bool {
+	switch {
+	case ip[0] == 0, ip[0] == 10, ip[0] == 127, ip[0] >= 224:
+		return false
+	case ip[0] == 100 && ip[1]&0xc0 == 64:
+		return false
+	case ip[0] == 169 && ip[1] == 254:
+		return false
+	case ip[0] == 172 && ip[1]&0xf0 == 16:
+		return false
+	case ip[0] == 192 && ip[1] == 168:
+		return false
+	}
+
+	return true
+}
+
+// availableServers returns the DNS servers that are not currently being skipped, in their configured order.
+// If every server is being skipped, all of the servers are returned so that queries continue to be attempted.
+func (c *DnsClient) availableServers() []string {
+	var servers []string
+	for _, d := range c.Servers {
+		if !dnsServerSkipped(d) {
+			servers = append(servers, d)
+		}
+	}
+
+	if len(servers) == 0 {
+		return c.Servers
+	}
+
+	return servers
+}
+
+// selfTest issues a query for the domain against each of the servers and logs whether each responded.
+// The response code is not checked; a server only fails the test if it does not respond.
+// It returns the number of servers that failed.
+func (c *DnsClient) selfTest(domain string) int {
+	var failed int
+	for _, d := range c.Servers {
+		q := new(dns.Msg)
+		q.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+		q.RecursionDesired = c.RecursionDesired
+		q.Id = dnsQueryId()
+
+		r, err := c.query(context.Background(), q, d)
+		if err != nil {
+			failed++
+			log.Printf("Self-test of DNS server '%s' failed: %v", d, err)
+			continue
+		}
+		log.Printf("Self-test of DNS server '%s' passed; %v", d, dns.RcodeToString[r.Rcode])
 	}
+
+	return failed
 }
 
-// dnsQuery performs the query against the designated DNS server.
+// systemServer returns a server picked at random from the system's resolv.conf, which is re-read every dnsSystemReread
+// so a changed resolver (e.g. from DHCP) is picked up. If no servers can be read, it returns an empty set.
+func (c *DnsClient) systemServer() []string {
+	c.systemMutex.Lock()
+	defer c.systemMutex.Unlock()
+
+	if time.Since(c.systemRead) > dnsSystemReread {
+		servers, err := dnsDefaultClientConfig()
+		if err != nil {
+			log.Printf("Unable to read the system resolvers: %v", err)
+		}
+		c.systemServers = servers
+		c.systemRead = time.Now()
+	}
+
+	if len(c.systemServers) == 0 {
+		return nil
+	}
+
+	return []string{c.systemServers[c.randomIntn(len(c.systemServers))]}
+}
+
+// random returns a random value in the range 0.0-1.0 (exclusive) from the client's random source.
+// The source is locked as the queries of a domain may be issued concurrently.
+func (c *DnsClient) random() float64 {
+	c.rngMutex.Lock()
+	defer c.rngMutex.Unlock()
+
+	return c.rng.Float64()
+}
+
+// randomIntn returns a random value in the range 0-n (exclusive) from the client's random source.
+func (c *DnsClient) randomIntn(n int) int {
+	c.rngMutex.Lock()
+	defer c.rngMutex.Unlock()
+
+	return c.rng.Intn(n)
+}
+
+// dnsQueryId generates a random ID for a DNS query message.
+// The ID is always drawn from crypto/rand (even if a deterministic seed is in use) to avoid any predictable ID sequence.
+// If crypto/rand is unavailable, it falls back to the DNS library's own ID generation.
+func dnsQueryId() uint16 {
+	var b [2]byte
+	_, err := crypto_rand.Read(b[:])
+	if err != nil {
+		log.Print(err.Error())
+		return dns.Id()
+	}
+
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// query performs the query against the designated DNS server.
 // If successful, it returns the response containing the appropriate resource records.
 // If the server is unable to resolve the query, it returns the appropriate resource records for the failure.
-// If there is a problem querying the server, nil is returned with a descriptive error.
+// If there is a problem querying the server, nil is returned with a descriptive error and it is counted as a transport error.
 // Note that this supports only a single query per server request.
-func dnsQuery(q *dns.Msg, d string) (*dns.Msg, error) {
+// The query is interrupted if the context is cancelled (or its deadline exceeded).
+// A fraction of the queries (per the TcpRate) are sent over TCP instead of UDP.
+// If retrying truncated responses, a truncated UDP response is replaced by the response to the query retried over TCP.
+func (c *DnsClient) query(ctx context.Context, q *dns.Msg, d string) (*dns.Msg, error) {
+	client := c.client
+	if c.TcpRate > 0 && c.random() < c.TcpRate {
+		client = c.tcpClient
+	}
+
 	// wrap the query with a timer for latency stats
+	atomic.AddInt64(&dnsQueriesSent, 1)
 	start := time.Now()
-	r, err := dns.Exchange(q, d)
-	metricsDnsRespTime(float64(time.Since(start).Milliseconds()), dns.TypeToString[q.Question[0].Qtype], d)
+	r, _, err := client.ExchangeContext(ctx, q, d)
+	rtt := time.Since(start)
+	c.responseTime(rtt, q, d)
+	metricsDnsNameserverUp(d, err == nil)
 	if err != nil {
+		dnsTransportError(ctx, d)
+		dnsRecordQuery(q, d, "ERROR", rtt)
 		return nil, err
 	}
 
+	// a real resolver retries a truncated response over TCP, reusing the same server
+	if r.Truncated && client != c.tcpClient && c.RetryTruncated {
+		metricsDnsTruncatedRetry()
+		atomic.AddInt64(&dnsQueriesSent, 1)
+		start = time.Now()
+		r, _, err = c.tcpClient.ExchangeContext(ctx, q, d)
+		rtt = time.Since(start)
+		c.responseTime(rtt, q, d)
+		metricsDnsNameserverUp(d, err == nil)
+		if err != nil {
+			dnsTransportError(ctx, d)
+			dnsRecordQuery(q, d, "ERROR", rtt)
+			return nil, err
+		}
+	}
+	dnsRecordQuery(q, d, dns.RcodeToString[r.Rcode], rtt)
+
+	// the size is that of the response as it would be on the wire (after any TCP retry)
+	metricsDnsRespBytes(float64(r.Len()), dns.TypeToString[q.Question[0].Qtype])
+
+	// a resolver that isn't recursing (or validating) is worth knowing about as it changes the character of the noise
+	if q.RecursionDesired && !r.RecursionAvailable {
+		metricsDnsRecursionUnavailable(d)
+	}
+	if r.Rcode == dns.RcodeSuccess && r.AuthenticatedData {
+		metricsDnsDnssecAd(dns.TypeToString[q.Question[0].Qtype], d)
+	}
+
 	// need to associate the rcode with the original query type and server info
 	metricsDnsReq(dns.TypeToString[q.Question[0].Qtype], d, dns.RcodeToString[r.Rcode])
 
@@ -184,29 +968,98 @@ func dnsQuery(q *dns.Msg, d string) (*dns.Msg, error) {
 
 	// note that AAAA queries may result in a response that has *no* RRs. this is the defined behavior ala RFC4074
 	// it signals there's no AAAA record but there *are* other record types for that domain
-	for _, a := range r.Answer {
+	// these "NODATA" responses are counted against the query type so they're still reflected in the metrics
+	if len(r.Answer) == 0 {
+		metricsDnsResp(dns.TypeToString[q.Question[0].Qtype], d, "NODATA")
+	}
+	// a resolver declining to answer an ANY query in full returns a single synthesized HINFO record instead (see RFC 8482)
+	// these minimal responses are counted against the query type so they can be told apart from a full answer
+	if q.Question[0].Qtype == dns.TypeANY && dnsMinimalAny(r) {
+		metricsDnsResp(dns.TypeToString[q.Question[0].Qtype], d, "RFC8482")
+	}
+	// an unusually large response only has the first records processed; the rest are counted against the query type
+	answers := r.Answer
+	if c.MaxAnswers > 0 && len(answers) > c.MaxAnswers {
+		metricsDnsRespAdd(dns.TypeToString[q.Question[0].Qtype], d, dns.RcodeToString[r.Rcode], len(answers)-c.MaxAnswers)
+		log.Printf("%v: %v; processing %d of %d answer records", dns.TypeToString[q.Question[0].Qtype], q.Question[0].Name, c.MaxAnswers, len(answers))
+		answers = answers[:c.MaxAnswers]
+	}
+	for _, a := range answers {
 		metricsDnsResp(dns.TypeToString[a.Header().Rrtype], d, dns.RcodeToString[r.Rcode])
 
-		// omit log for each record received; may reenable later with a logging level option
-		/*
-			switch a.(type) {
-			case *dns.A:
-				rr := a.(*dns.A)
-				log.Printf("%v: %v->%v; %v", dns.TypeToString[rr.Header().Rrtype], q.Question[0].Name, rr.A, dns.RcodeToString[r.Rcode])
-			case *dns.AAAA:
-				rr := a.(*dns.AAAA)
-				log.Printf("%v: %v->%v; %v", dns.TypeToString[rr.Header().Rrtype], q.Question[0].Name, rr.AAAA, dns.RcodeToString[r.Rcode])
-			case *dns.CNAME:
-				rr := a.(*dns.CNAME)
-				log.Printf("%v: %v->%v; %v", dns.TypeToString[rr.Header().Rrtype], q.Question[0].Name, rr.Target, dns.RcodeToString[r.Rcode])
-			case *dns.MX:
-				rr := a.(*dns.MX)
-				log.Printf("%v: %v->%v; %v", dns.TypeToString[rr.Header().Rrtype], q.Question[0].Name, rr.Mx, dns.RcodeToString[r.Rcode])
-			default:
-				log.Printf("%v: Unexpected answer type", reflect.TypeOf(a))
-			}
-		*/
+		if dnsAnswerLog != nil {
+			dnsLogAnswer(a, q.Question[0].Name, dns.RcodeToString[r.Rcode], d)
+		}
 	}
 
 	return r, nil
 }
+
+// dnsTransportError counts a query against the DNS server which failed without a response (e.g. a connection error or
+// a timeout), as opposed to a response with a failure rcode. A query interrupted by the context (on shutdown) is not counted.
+func dnsTransportError(ctx context.Context, d string) {
+	if ctx.Err() == nil {
+		metricsDnsTransportError(d)
+	}
+}
+
+// responseTime records the response time of the query against the DNS server, counting the query as slow if it exceeds
+// the SlowQuery threshold.
+func (c *DnsClient) responseTime(elapsed time.Duration, q *dns.Msg, d string) {
+	metricsDnsRespTime(float64(elapsed.Milliseconds()), dns.TypeToString[q.Question[0].Qtype], d)
+	if c.SlowQuery > 0 && elapsed > c.SlowQuery {
+		metricsDnsSlowQuery(d)
+	}
+}
+
+// dnsMinimalAny checks whether the response to an ANY query is the minimal HINFO response of RFC 8482.
+func dnsMinimalAny(r *dns.Msg) bool {
+	if len(r.Answer) != 1 {
+		return false
+	}
+
+	hinfo, ok := r.Answer[0].(*dns.HINFO)
+	return ok && hinfo.Cpu == "RFC8482"
+}
+
+// dnsLogAnswer logs the answer record using the configured answer log template.
+// Only the record data for the 'A', 'AAAA', 'CNAME', 'MX', 'TXT', 'DNAME', 'NAPTR', and 'HINFO' types are extracted; other types
+// log the full record.
+func dnsLogAnswer(a dns.RR, name, rcode, server string) {
+	answer := dnsAnswer{
+		Type:   dns.TypeToString[a.Header().Rrtype],
+		Name:   name,
+		Rcode:  rcode,
+		Server: server,
+	}
+
+	switch rr := a.(type) {
+	case *dns.A:
+		answer.Answer = rr.A.String()
+	case *dns.AAAA:
+		answer.Answer = rr.AAAA.String()
+	case *dns.CNAME:
+		answer.Answer = rr.Target
+	case *dns.MX:
+		answer.Answer = rr.Mx
+	case *dns.TXT:
+		answer.Answer = strings.Join(rr.Txt, " ")
+	case *dns.DNAME:
+		answer.Answer = rr.Target
+	case *dns.NAPTR:
+		answer.Answer = fmt.Sprintf("%d %d \"%s\" \"%s\" \"%s\" %s", rr.Order, rr.Preference, rr.Flags, rr.Service, rr.Regexp, rr.Replacement)
+	case *dns.HINFO:
+		answer.Answer = fmt.Sprintf("\"%s\" \"%s\"", rr.Cpu, rr.Os)
+	default:
+		answer.Answer = a.String()
+	}
+
+	var b strings.Builder
+	err := dnsAnswerLog.Execute(&b, answer)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	log.Print(b.String())
+}
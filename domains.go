@@ -6,152 +6,983 @@ package main
 
 import (
 	"archive/zip"
+	"compress/gzip"
+	"container/list"
+	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/miekg/dns"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 )
 
 // General functions for fetching the list of DNS domains to be used as noise values.
 
+// fetchClient is the HTTP client used for fetching the domains sources.
+var fetchClient = http.DefaultClient
+
+// fetchClientConfig sets up the HTTP client used for fetching the domains sources.
+// If a proxy URL is supplied, all source fetches will be routed through it. Both http and socks5 proxies are supported.
+// If the proxy is empty, the standard proxy environment variables (if any) will be honored.
+// If insecure, the certificates of https sources are not verified; this is intended only for internal CAs or self-signed certificates.
+// If an outInterface is configured, the fetches are bound to it (see outInterfaceConfig).
+// It is a fatal error if the proxy URL cannot be parsed.
+func fetchClientConfig(proxy string, insecure bool) {
+	if proxy == "" && !insecure && outDialer == nil {
+		return
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+			break
+		default:
+			log.Fatalf("Unsupported proxy scheme: '%v'", proxyURL.Scheme)
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+		log.Printf("Fetching sources via proxy '%s://%s'", proxyURL.Scheme, proxyURL.Host)
+	}
+
+	if insecure {
+		log.Println("WARNING: TLS certificate verification disabled for source fetches")
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	if outDialer != nil {
+		transport.DialContext = outDialer.DialContext
+	}
+
+	fetchClient = &http.Client{Transport: transport}
+}
+
 //
-// Fetch the domains, unzipping if needed
-// The domains file must be either a csv or a zip-encoded csv
-// Returns back a file pointer to the csv
-func fetchDomains(sourceURL string) *os.File {
-	domainsFile := fetchFile(sourceURL)
+// Fetch the domains, unzipping (or gunzipping) if needed
+// The domains file must be either a csv or a zip/gzip/xz/zstd-encoded csv, unless the source is in hosts format
+// Returns back a file pointer to the domains file or the error encountered
+func fetchDomains(sourceURL, label, format string, headers map[string]string) (*os.File, error) {
+	domainsFile, err := fetchFile(sourceURL, label, headers)
+	if err != nil {
+		return nil, err
+	}
 
-	// Check the extension; if .zip then unzip it
+	// Check the extension; if .zip then unzip it, if .gz then gunzip it, if .xz or .zst then decompress it
 	extension := strings.ToLower(filepath.Ext(domainsFile.Name()))
-	if extension == ".zip" {
-		domainsFile = unzipFile(domainsFile)
+	switch extension {
+	case ".zip":
+		domainsFile, err = unzipFile(domainsFile)
+	case ".gz":
+		domainsFile, err = gunzipFile(domainsFile)
+	case ".xz":
+		domainsFile, err = xzFile(domainsFile)
+	case ".zst":
+		domainsFile, err = zstdFile(domainsFile)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	// Recheck the extension (if may have changed if unzipped)
+	// hosts files are commonly published without any extension at all
 	extension = strings.ToLower(filepath.Ext(domainsFile.Name()))
-	if extension != ".csv" {
-		log.Fatal("Unexpected file format: '%v'", extension)
+	if format == "csv" && extension != ".csv" {
+		os.Remove(domainsFile.Name())
+		return nil, fmt.Errorf("Unexpected file format: '%v'", extension)
 	}
 
-	return domainsFile
+	return domainsFile, nil
 }
 
 //
 // Fetch file from remote source and save it in the tmp dir
+// The HTTP status of each fetch is counted against the source label
+// The headers (e.g. "Authorization") are added to the request with any environment variables in their values expanded
+// A local file ("file:///path/to/file") is copied into the tmp dir instead, so it is handled like any fetched file
+// An object in S3 ("s3://bucket/key") or GCS ("gs://bucket/object") is fetched from the store's https endpoint
 //
-func fetchFile(sourceURL string) *os.File {
-	response, err := http.Get(sourceURL)
+func fetchFile(sourceURL, label string, headers map[string]string) (*os.File, error) {
+	if strings.HasPrefix(sourceURL, "file://") {
+		localFile, err := os.Open(strings.TrimPrefix(sourceURL, "file://"))
+		if err != nil {
+			return nil, err
+		}
+		defer localFile.Close()
+
+		return saveFile(localFile, sourceURL)
+	}
+
+	// objects in S3 or GCS are fetched over https with the credentials from the environment
+	requestURL, store, err := objectStoreURL(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest(http.MethodGet, requestURL, nil)
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, err
+	}
+	for name, value := range headers {
+		request.Header.Set(name, os.ExpandEnv(value))
+	}
+	objectStoreAuth(request, store)
+
+	response, err := fetchClient.Do(request)
+	if err != nil {
+		metricsSourceFetch(label, "error")
+		return nil, err
 	}
 	defer response.Body.Close()
 
+	metricsSourceFetch(label, strconv.Itoa(response.StatusCode))
 	if response.StatusCode != http.StatusOK {
-		log.Fatal("Unable to fetch domains source: %v", response.StatusCode)
+		return nil, fmt.Errorf("Unable to fetch domains source: %v", response.StatusCode)
 	}
 
-	// create a file in the tmp directory
-	domainsFile, err := os.Create(filepath.Join(os.TempDir(), filepath.Base(sourceURL)))
+	return saveFile(response.Body, sourceURL)
+}
+
+// saveFile writes the contents of the reader into a new file in the tmp dir named after the source URL.
+// It returns the (closed) file or the error encountered.
+func saveFile(r io.Reader, sourceURL string) (*os.File, error) {
+	// create a uniquely named file in the tmp directory (sources may be fetched concurrently)
+	// the original name is kept as the suffix to preserve the extension
+	domainsFile, err := ioutil.TempFile(os.TempDir(), "*-"+filepath.Base(sourceURL))
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, err
 	}
 	defer domainsFile.Close()
 
-	// write the full response body into the newly created file
-	_, err = io.Copy(domainsFile, response.Body)
+	// write the full response body into the newly created file (a partial file is removed)
+	_, err = io.Copy(domainsFile, r)
+	if err != nil {
+		os.Remove(domainsFile.Name())
+		return nil, err
+	}
+
+	return domainsFile, nil
+}
+
+//
+// Decompress the xz file and save it in the tmp dir
+// The xz file is removed once decompressed
+//
+func xzFile(compressedFile *os.File) (*os.File, error) {
+	return decompressFile(compressedFile, "xz")
+}
+
+//
+// Decompress the zstd file and save it in the tmp dir
+// The zstd file is removed once decompressed
+//
+func zstdFile(compressedFile *os.File) (*os.File, error) {
+	return decompressFile(compressedFile, "zstd")
+}
+
+//
+// Decompress the file with the command (e.g. "xz") and save it in the tmp dir
+// The command must be installed and accept the -d (decompress) and -c (to stdout) options, as xz and zstd do
+// The compressed file is removed once decompressed
+//
+func decompressFile(compressedFile *os.File, command string) (_ *os.File, err error) {
+	// on failure, the compressed file is removed along with any partial output
+	var decompressedFile *os.File
+	defer func() {
+		if err != nil {
+			os.Remove(compressedFile.Name())
+			if decompressedFile != nil {
+				os.Remove(decompressedFile.Name())
+			}
+		}
+	}()
+
+	// the decompressed file keeps the original name without the compression extension (e.g. "top-1m.csv")
+	decompressedFilename := strings.TrimSuffix(filepath.Base(compressedFile.Name()), filepath.Ext(compressedFile.Name()))
+	decompressedFile, err = ioutil.TempFile(os.TempDir(), "*-"+decompressedFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressedFile.Close()
+
+	var stderr strings.Builder
+	cmd := exec.Command(command, "-d", "-c", compressedFile.Name())
+	cmd.Stdout = decompressedFile
+	cmd.Stderr = &stderr
+	err = cmd.Run()
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, fmt.Errorf("Unable to decompress '%s' with %s: %v %s", filepath.Base(compressedFile.Name()), command, err, strings.TrimSpace(stderr.String()))
 	}
 
-	return domainsFile
+	err = os.Remove(compressedFile.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	return decompressedFile, nil
+}
+
+//
+// Gunzip the file and save it in the tmp dir
+// The gzipped file is removed once decompressed
+//
+func gunzipFile(gzipFile *os.File) (_ *os.File, err error) {
+	// on failure, the compressed file is removed along with any partial output
+	var gunzippedFile *os.File
+	defer func() {
+		if err != nil {
+			os.Remove(gzipFile.Name())
+			if gunzippedFile != nil {
+				os.Remove(gunzippedFile.Name())
+			}
+		}
+	}()
+
+	compressedFile, err := os.Open(gzipFile.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer compressedFile.Close()
+
+	gzipReader, err := gzip.NewReader(compressedFile)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+
+	// the decompressed file keeps the original name without the .gz extension (e.g. "top-1m.csv")
+	gunzippedFilename := strings.TrimSuffix(filepath.Base(gzipFile.Name()), filepath.Ext(gzipFile.Name()))
+	gunzippedFile, err = ioutil.TempFile(os.TempDir(), "*-"+gunzippedFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer gunzippedFile.Close()
+
+	_, err = io.Copy(gunzippedFile, gzipReader)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Remove(gzipFile.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	return gunzippedFile, nil
 }
 
 //
 // Unzip the file and save it in the tmp dir
 //
-func unzipFile(zipFile *os.File) *os.File {
+func unzipFile(zipFile *os.File) (_ *os.File, err error) {
+	// on failure, the compressed file is removed along with any partial output
+	var unzippedFile *os.File
+	defer func() {
+		if err != nil {
+			os.Remove(zipFile.Name())
+			if unzippedFile != nil {
+				os.Remove(unzippedFile.Name())
+			}
+		}
+	}()
+
 	zipReader, err := zip.OpenReader(zipFile.Name())
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, err
 	}
+	defer zipReader.Close()
 
 	// There should only be a single zipped file for the domains
-	// Anything more is a problem
-	if len(zipReader.File) > 1 {
-		log.Fatal("Unexpected number of zipped files: %v", len(zipReader.File))
+	// Anything more (or less) is a problem
+	if len(zipReader.File) != 1 {
+		return nil, fmt.Errorf("Unexpected number of zipped files: %v", len(zipReader.File))
 	}
 
 	// Open the first (only!) zipped file for reading
 	zippedFile, err := zipReader.File[0].Open()
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, err
 	}
 	defer zippedFile.Close()
 
 	// Extract out only the basename for the zipped file and use it
-	// to create a destination file of the same name in the tmp directory
+	// to create a uniquely named destination file with the same suffix in the tmp directory
 	unzippedFilename := filepath.Base(zipReader.File[0].FileHeader.Name)
-	unzippedFile, err := os.Create(filepath.Join(os.TempDir(), unzippedFilename))
+	unzippedFile, err = ioutil.TempFile(os.TempDir(), "*-"+unzippedFilename)
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, err
 	}
 	defer unzippedFile.Close()
 
 	// Decodes the zipped file into the destination file
 	_, err = io.Copy(unzippedFile, zippedFile)
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, err
 	}
 
 	err = os.Remove(zipFile.Name())
 	if err != nil {
-		log.Printf(err.Error())
+		log.Print(err.Error())
 	}
 
-	return unzippedFile
+	return unzippedFile, nil
 }
 
-//
-// Check the source to see if it has exceeded its refresh period
-func checkSourceRefresh(s Source) bool {
-	refresh := false
+// fetchSource fetches the domains file for the source.
+// Sources with an inline list of domains have nothing to fetch.
+// It returns the path of the fetched file (empty for an inline source) or the error encountered.
+func fetchSource(s *Source) (string, error) {
+	if len(s.Domains) > 0 {
+		return "", nil
+	}
+
+	domainsFile, err := fetchDomains(s.Url, s.Label, s.Format, s.Headers)
+	if err != nil {
+		return "", err
+	}
+
+	return domainsFile.Name(), nil
+}
+
+// fetchSources fetches the domains files for all of the sources concurrently.
+// At most parallel fetches will be in flight at any time in order to avoid hammering a provider hosting multiple sources.
+// If stagger is non-zero, each fetch is started a random gap of up to stagger after the previous one rather than all at once.
+// It returns the paths of the fetched files in the same order as the sources (empty for a failed fetch), along with the
+// errors of all the failed fetches combined into one, each prefixed by the label of its source.
+func fetchSources(sources []*Source, parallel int, stagger time.Duration) ([]string, error) {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	// the start delays accumulate so the gaps between the starts are random (the first fetch starts immediately)
+	delays := make([]time.Duration, len(sources))
+	if stagger > 0 && len(sources) > 1 {
+		rng := newRand()
+		for i := 1; i < len(sources); i++ {
+			delays[i] = delays[i-1] + time.Duration(rng.Int63n(int64(stagger)))
+		}
+		log.Printf("Staggering the source downloads over %v", delays[len(delays)-1].Round(time.Second))
+	}
+
+	paths := make([]string, len(sources))
+	errs := make([]error, len(sources))
+
+	// the buffered channel acts as a semaphore limiting the number of concurrent fetches
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for i := range sources {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(delays[i])
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			paths[i], errs[i] = fetchSource(sources[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("'%s': %v", sources[i].Label, err))
+		}
+	}
+	if len(failed) > 0 {
+		return paths, fmt.Errorf("Unable to fetch domains sources %s", strings.Join(failed, "; "))
+	}
+
+	return paths, nil
+}
+
+// loadSource loads the fetched domains file into the database according to the source's format and load mode.
+// Sources with an inline list of domains are loaded directly and the path is ignored.
+// If the SHA-256 hash of the domains file is unchanged since the source was last loaded (e.g. a provider republishing an
+// identical list), the reload is skipped to avoid the churn of purging and reloading the same data.
+// After loading, the total number of domains is checked against warnDomains (if non-zero) as a sanity check.
+// It returns any error encountered while loading.
+func loadSource(db *sql.DB, path string, s *Source, warnDomains int) error {
+	var err error
+
+	var hash string
+	if len(s.Domains) == 0 {
+		hash, err = fileHash(path)
+		if err != nil {
+			return err
+		}
+		if hash == s.Hash {
+			log.Printf("Domains source '%s' is unchanged; skipped reload", s.Label)
+			metricsSourceUnchanged(s.Label)
+			return nil
+		}
+	}
+
+	switch {
+	case len(s.Domains) > 0:
+		err = dbLoadList(db, s)
+	case s.Format == "hosts":
+		err = dbLoadHosts(db, path, s)
+	case s.Format == "replay":
+		err = dbLoadReplay(db, path, s)
+	default:
+		err = dbLoadCSV(db, path, s)
+	}
+	if err != nil {
+		return err
+	}
+	s.Hash = hash
+
+	checkDomainsLimit(db, warnDomains)
+
+	return nil
+}
+
+// fileHash returns the hex-encoded SHA-256 hash of the contents of the file.
+// If the file cannot be read, it returns the error encountered.
+func fileHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkDomainsLimit compares the number of domains in the database against the expected maximum.
+// Exceeding the maximum is not an error but usually indicates rows accumulating across refreshes (e.g. a label mismatch),
+// so a warning is logged and the condition is exposed as a metric. A warnDomains of 0 disables the check.
+func checkDomainsLimit(db *sql.DB, warnDomains int) {
+	if warnDomains <= 0 {
+		return
+	}
+
+	numRows, err := dbCountRows(db)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	exceeded := numRows > warnDomains
+	if exceeded {
+		log.Printf("Number of domains (%d) exceeds expected maximum (%d)", numRows, warnDomains)
+	}
+	metricsDnsNoiseDomainsExceeded(exceeded)
+}
+
+// logSourcesSummary logs the number of domains loaded for each source and the total number of domains available.
+// A source without any domains (e.g. a wrong column or an empty file) is flagged so it stands out.
+// Errors are logged but otherwise ignored as the summary is only informative.
+func logSourcesSummary(db *sql.DB, sources []Source) {
+	log.Printf("Loaded %d sources:", len(sources))
+	for _, s := range sources {
+		origin := s.Url
+		if len(s.Domains) > 0 {
+			origin = "inline"
+		}
+
+		numRows, err := dbCountLabel(db, s.Label)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		warning := ""
+		if numRows == 0 {
+			warning = " WARNING: no domains loaded"
+		}
+		log.Printf("  source '%s' (%s): %d domains%s", s.Label, origin, numRows, warning)
+	}
+
+	total, err := dbCountRows(db)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	log.Printf("  total: %d domains available", total)
+}
+
+// parseHostsLine extracts the domains from a single line of a hosts-format file (e.g. "0.0.0.0 ads.example.com").
+// The leading IP address, comments, and any entries that are IP addresses or bare hostnames (e.g. "localhost") are ignored.
+// It returns the domains found, which may be none, and the number of entries filtered out.
+func parseHostsLine(line string) ([]string, int) {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, 0
+	}
+
+	var domains []string
+	var filtered int
+	for _, host := range fields[1:] {
+		if net.ParseIP(host) != nil || !strings.Contains(host, ".") {
+			filtered++
+			continue
+		}
+		domains = append(domains, host)
+	}
+
+	return domains, filtered
+}
+
+// parseReplayLine parses a line of query names exported from a packet capture into the query name.
+// The name may be preceded by timing fields (e.g. tshark's "frame.time_epoch") and followed by other fields (e.g. the query type),
+// separated by whitespace or commas; the first field which is not a number is taken as the name. Comments and blank lines are ignored.
+// It returns the query name without the trailing root dot, or an empty string if the line has none.
+func parseReplayLine(line string) string {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for _, field := range fields {
+		if _, err := strconv.ParseFloat(field, 64); err == nil {
+			continue
+		}
+		return strings.ToLower(strings.TrimSuffix(field, "."))
+	}
+
+	return ""
+}
+
+// validDomain checks whether the domain is a syntactically valid domain name.
+// It returns a bool reflecting whether the domain is valid or not.
+func validDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+
+	_, ok := dns.IsDomainName(domain)
+	return ok
+}
+
+// refreshSources starts an independent refresh timer for each domains source with a refresh period.
+// Each source is refreshed in the background on its own schedule, regardless of the query rate.
+// The first refresh occurs one refresh period after startup in order to avoid nuking the database if the -r flag has been used.
+// A refresh interval shorter than minRefresh (e.g. a typo) is raised to it with a warning, so the provider isn't hammered.
+// Note that the index is used to access the slice entry directly as the value returned by range is only a copy.
+func refreshSources(db *sql.DB, sources []Source, warnDomains int, minRefresh time.Duration) {
+	for i := range sources {
+		sources[i].Timestamp = time.Now()
+		if (sources[i].Refresh <= 0 && sources[i].RefreshCron == nil) || len(sources[i].Domains) > 0 {
+			continue
+		}
+
+		if sources[i].RefreshCron == nil && sources[i].Refresh.Duration() < minRefresh {
+			log.Printf("WARNING: refresh of %v for source '%s' is below the minimum; using %v", sources[i].Refresh.Duration(), sources[i].Label, minRefresh)
+			sources[i].Refresh = Duration(minRefresh)
+		}
+
+		if sources[i].RefreshCron != nil {
+			log.Printf("Initialized source '%s' refresh at '%v'", sources[i].Label, sources[i].RefreshCron)
+		} else {
+			log.Printf("Initialized source '%s' refresh every %v", sources[i].Label, sources[i].Refresh.Duration())
+		}
+		go refreshSource(db, &sources[i], warnDomains, minRefresh)
+	}
+}
+
+// refreshSource periodically fetches a new datafile from the source and reloads the database with it.
+// The source is refreshed at the times matching its cron expression if it has one, otherwise at its refresh interval.
+// A cron expression matching more often than minRefresh has the matching times within minRefresh of the last refresh skipped.
+// It runs until the application exits and is intended to be run as a goroutine.
+func refreshSource(db *sql.DB, s *Source, warnDomains int, minRefresh time.Duration) {
+	for {
+		wait := s.Refresh.Duration()
+		if s.RefreshCron != nil {
+			from := time.Now()
+			if earliest := s.Timestamp.Add(minRefresh); earliest.After(from) {
+				from = earliest.Add(-time.Minute)
+			}
+			next := s.RefreshCron.next(from)
+			if next.IsZero() {
+				log.Printf("Cron expression '%v' for source '%s' never matches; refresh disabled", s.RefreshCron, s.Label)
+				return
+			}
+			wait = time.Until(next)
+		}
+		time.Sleep(wait)
 
-	if s.Refresh != 0 && time.Since(s.Timestamp) > s.Refresh.Duration() {
 		log.Printf("Refreshing domains source '%s'", s.Label)
-		refresh = true
-	}
-
-	return refresh
-}
-
-// refreshSources checks to see if any domain sources need to be refreshed and reloads them if so.
-// It will fetch a new datafile from the source and reload the database for each dataset that needs refreshing.
-func refreshSources(db *sql.DB, sources []Source) {
-	for i, s := range sources {
-		// if timestamp has not been initialized, then set it and continue. do *not* refresh the database if
-		// the timestamp has not been set in order to avoid nuking the database if the -r flag has been used.
-		// fantastic subtlety in syntax here: while slices are passed in as a value, the contents of the slice are
-		// effectively passed in by ref. this means you can modify an *existing* slice entry but adding/removing an
-		// entry will not persist outside of scope. modifying the timestamp for an *existing* slice entry should
-		// persist. however, when the slice entry is returned from the range function, it is a *value* copy of the
-		// slice entry and NOT the original! this means any modification will NOT persist outside of scope if made
-		// against the copy returned by range. however, if you instead use the index value to access directly into
-		// the slice you can successfully modify the contents and have it persist. perfectly logical if not perfectly obvious.
-		if s.Timestamp.IsZero() {
-			sources[i].Timestamp = time.Now()
-			log.Printf("Initialized source '%s' refresh to %v", s.Label, sources[i].Timestamp)
+		// a failed refresh is not fatal; the existing data (if any) remains and the refresh is retried next period
+		sourceFile, err := fetchDomains(s.Url, s.Label, s.Format, s.Headers)
+		if err == nil {
+			err = loadSource(db, sourceFile.Name(), s, warnDomains)
+			os.Remove(sourceFile.Name())
+		}
+		if err == nil {
+			err = dbOptimize(db)
+			sweep.reset()
+		}
+		if err != nil {
+			log.Printf("Unable to refresh domains source '%s': %v", s.Label, err)
+		}
+
+		s.Timestamp = time.Now()
+	}
+}
+
+// tldCounts tracks the number of noise domains selected for each top-level domain.
+// tldTotal is the total number of noise domains selected across all top-level domains.
+var tldCounts = make(map[string]int)
+var tldTotal int
+
+// selectMaxAttempts is the number of selections attempted before accepting a domain that would otherwise be passed over.
+const selectMaxAttempts = 10
+
+// recentDomains tracks the most recently selected domains so they can be passed over if selected again too soon.
+// It is a simple LRU cache with a maximum size, where entries also expire after the ttl.
+type recentDomains struct {
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// recentEntry is a single entry in the recentDomains cache.
+type recentEntry struct {
+	domain string
+	added  time.Time
+}
+
+// recentCache contains the recently selected domains. A size of 0 disables the cache.
+var recentCache = newRecentDomains(0, 0)
+
+// newRecentDomains creates an empty cache of the recently selected domains.
+func newRecentDomains(size int, ttl time.Duration) *recentDomains {
+	return &recentDomains{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// labelWeight is the selection weight of a source label.
+type labelWeight struct {
+	label  string
+	weight float64
+}
+
+// sourceWeights contains the selection weight of each source label in the order of the sources, so the selection is
+// reproducible with a fixed seed. If empty, domains are selected uniformly across all sources.
+// The weights may be replaced at runtime when the noise profile is switched, so they are guarded by sourceWeightsMutex.
+var sourceWeights []labelWeight
+var sourceWeightsMutex sync.RWMutex
+
+// sourceWeightsConfig sets up the selection weights of the sources.
+// If none of the sources has a weight, the weights are left empty; otherwise sources without a weight have a weight of 1.
+func sourceWeightsConfig(sources []Source) {
+	setSourceWeights(sources, nil)
+}
+
+// setSourceWeights replaces the selection weights of the sources, with the weights of the overrides (e.g. those of a noise
+// profile) taking precedence over the sources' own weights. A weight of 0 in the overrides excludes the source.
+// If none of the sources has a weight, the weights are left empty; otherwise sources without a weight have a weight of 1.
+func setSourceWeights(sources []Source, overrides map[string]float64) {
+	var weights []labelWeight
+	weighted := len(overrides) > 0
+	for _, s := range sources {
+		if s.Weight > 0 {
+			weighted = true
+		}
+	}
+
+	if weighted {
+		for _, s := range sources {
+			w := 1.0
+			if o, ok := overrides[s.Label]; ok {
+				w = o
+			} else if s.Weight > 0 {
+				w = s.Weight
+			}
+			weights = append(weights, labelWeight{label: s.Label, weight: w})
+		}
+	}
+
+	sourceWeightsMutex.Lock()
+	sourceWeights = weights
+	sourceWeightsMutex.Unlock()
+}
+
+// selectSourceLabel chooses a source label with a probability proportional to its weight, passing over the excluded labels.
+// A source with a weight of 0 is never chosen.
+// If the sources are not weighted, it returns an empty string. If they are but none of the labels with a positive weight
+// remain, it returns an error.
+func selectSourceLabel(rng *rand.Rand, exclude map[string]bool) (string, error) {
+	sourceWeightsMutex.RLock()
+	defer sourceWeightsMutex.RUnlock()
+
+	if len(sourceWeights) == 0 {
+		return "", nil
+	}
+
+	var total float64
+	var last string
+	for _, sw := range sourceWeights {
+		if sw.weight > 0 && !exclude[sw.label] {
+			total += sw.weight
+			last = sw.label
+		}
+	}
+	if total <= 0 {
+		return "", fmt.Errorf("No domains available from the weighted sources")
+	}
+
+	// the last candidate also takes up any rounding left over from the subtractions
+	pick := rng.Float64() * total
+	for _, sw := range sourceWeights {
+		if sw.weight <= 0 || exclude[sw.label] {
 			continue
 		}
+		pick -= sw.weight
+		if pick < 0 {
+			return sw.label, nil
+		}
+	}
+
+	return last, nil
+}
+
+// recentCacheConfig sets up the cache of recently selected domains from the noise configuration.
+func recentCacheConfig(n *Noise) {
+	recentCache = newRecentDomains(n.RecentSize, n.RecentTtl.Duration())
+}
+
+// seen checks whether the domain was selected within the ttl.
+// It returns a bool reflecting whether the domain is in the cache or not.
+func (r *recentDomains) seen(domain string) bool {
+	e, ok := r.entries[domain]
+	if !ok {
+		return false
+	}
+
+	if time.Since(e.Value.(*recentEntry).added) > r.ttl {
+		r.order.Remove(e)
+		delete(r.entries, domain)
+		return false
+	}
+
+	return true
+}
+
+// add records the domain as selected, evicting the least recently selected domain if the cache is full.
+func (r *recentDomains) add(domain string) {
+	if r.size <= 0 {
+		return
+	}
 
-		if checkSourceRefresh(s) {
-			sourceFile := fetchDomains(s.Url)
-			dbLoadCSV(db, sourceFile.Name(), s.Label, s.Column)
+	if e, ok := r.entries[domain]; ok {
+		e.Value.(*recentEntry).added = time.Now()
+		r.order.MoveToFront(e)
+		return
+	}
+
+	r.entries[domain] = r.order.PushFront(&recentEntry{domain: domain, added: time.Now()})
+	if r.order.Len() > r.size {
+		oldest := r.order.Back()
+		r.order.Remove(oldest)
+		delete(r.entries, oldest.Value.(*recentEntry).domain)
+	}
+}
 
-			sources[i].Timestamp = time.Now()
+// domainTld extracts the top-level domain (e.g. "com") from the domain supplied.
+// It returns the lowercased TLD without any trailing root dot.
+func domainTld(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	return domain[strings.LastIndex(domain, ".")+1:]
+}
+
+// selectRandomDomain fetches a random domain (and its source's label and query types) from the database while tracking the
+// distribution of TLDs selected.
+// If the sources are weighted, a source is chosen by weight first (see selectSourceLabel) and the domain fetched from it.
+// A weighted source without any domains (e.g. a failed load) falls back to choosing among the other weighted sources;
+// a source with a weight of 0 is never selected from.
+// If maxPct is in the range 1-99, domains whose TLD would exceed that percentage of all selections are passed over
+// and another domain selected. Domains selected recently (see recentCache) are likewise passed over, as are domains with
+// an unexpired answer for the source's query types (see answerCache).
+// If adaptive, domains which have failed to resolve more often than they have resolved are passed over as well.
+// After selectMaxAttempts the last domain fetched is accepted regardless.
+// If it is unable to fetch a domain, it will return an error and the domain will be empty.
+func selectRandomDomain(db *sql.DB, rng *rand.Rand, maxPct int, adaptive bool) (string, string, []string, error) {
+	var domain, source, tld string
+	var types []string
+	var err error
+
+	for i := 0; i < selectMaxAttempts; i++ {
+		var exclude map[string]bool
+		for {
+			var label string
+			label, err = selectSourceLabel(rng, exclude)
+			if err != nil {
+				return "", "", nil, err
+			}
+			domain, source, types, err = dbGetRandomDomain(db, rng, label)
+			if err == nil || label == "" {
+				break
+			}
+			if exclude == nil {
+				exclude = make(map[string]bool)
+			}
+			exclude[label] = true
+		}
+		if err != nil {
+			return "", "", nil, err
+		}
+
+		tld = domainTld(domain)
+		if recentCache.seen(domain) || answerCache.cached(domain, types) {
+			continue
+		}
+		if adaptive {
+			successes, failures, err := dbGetResults(db, domain)
+			if err == nil && failures > successes {
+				continue
+			}
+		}
+		if maxPct <= 0 || maxPct >= 100 {
+			break
+		}
+		if (tldCounts[tld]+1)*100 <= maxPct*(tldTotal+1) {
+			break
 		}
 	}
+
+	tldCounts[tld]++
+	tldTotal++
+	metricsDnsTld(tld)
+	recentCache.add(domain)
+
+	return domain, source, types, nil
+}
+
+// domainSweep walks through all of the domains in the database in a shuffled order, reshuffling at the end of each pass,
+// so every domain is eventually selected. The order is rebuilt once the sweep is reset (e.g. after a source is refreshed).
+type domainSweep struct {
+	mutex sync.Mutex
+	ids   []int64
+	next  int
+	stale bool
+}
+
+// sweep contains the order of the domains for the "sweep" selection.
+var sweep = &domainSweep{stale: true}
+
+// reset marks the order of the domains as stale, so it is rebuilt on the next selection.
+func (w *domainSweep) reset() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.stale = true
+}
+
+// selectDomain fetches the next domain (and its source's label and query types) of the sweep.
+// The row ids are loaded and shuffled at the start of each pass or if the sweep is stale. Rows which no longer exist
+// (e.g. pruned domains) are skipped. If it is unable to fetch a domain, it will return an error and the domain will be empty.
+func (w *domainSweep) selectDomain(db *sql.DB, rng *rand.Rand) (string, string, []string, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	reloaded := false
+	for {
+		if w.stale || w.next >= len(w.ids) {
+			// a fresh pass without any usable rows would otherwise reload forever
+			if reloaded {
+				return "", "", nil, fmt.Errorf("No domains available in database")
+			}
+			reloaded = true
+
+			ids, err := dbGetDomainIds(db)
+			if err != nil {
+				return "", "", nil, err
+			}
+			if len(ids) == 0 {
+				return "", "", nil, fmt.Errorf("No domains available in database")
+			}
+			rng.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+
+			w.ids, w.next, w.stale = ids, 0, false
+			log.Printf("Starting a sweep of %d domains", len(ids))
+		}
+
+		id := w.ids[w.next]
+		w.next++
+		domain, label, types, err := dbGetDomain(db, id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return "", "", nil, err
+		}
+
+		metricsDnsTld(domainTld(domain))
+		return domain, label, types, nil
+	}
+}
+
+// mailSelectors are common DKIM selectors used for generating the DKIM key names queried.
+var mailSelectors = []string{"default", "google", "selector1", "selector2", "k1", "s1", "dkim", "mail"}
+
+// mailDomain returns a mail authentication name for the domain, as queried (for a TXT record) by mail servers.
+// It is randomly one of the DMARC policy name, a DKIM key name with a common selector, or the domain itself (for SPF).
+func mailDomain(rng *rand.Rand, domain string) string {
+	switch rng.Intn(3) {
+	case 0:
+		return "_dmarc." + domain
+	case 1:
+		return mailSelectors[rng.Intn(len(mailSelectors))] + "._domainkey." + domain
+	default:
+		return domain
+	}
+}
+
+// syntheticChars are the characters used for generating the label of a synthetic domain.
+const syntheticChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// syntheticDomain generates a random domain name (e.g. "k3jd8slq.com") which in all likelihood does not exist.
+// The top-level domain is randomly selected from the TLDs supplied, which should be plausible ones to avoid being a fingerprint.
+// If no TLDs are supplied, "com" is used.
+func syntheticDomain(rng *rand.Rand, tlds []string) string {
+	tld := "com"
+	if len(tlds) > 0 {
+		tld = tlds[rng.Intn(len(tlds))]
+	}
+
+	label := make([]byte, 6+rng.Intn(9))
+	for i := range label {
+		label[i] = syntheticChars[rng.Intn(len(syntheticChars))]
+	}
+
+	return string(label) + "." + strings.TrimPrefix(tld, ".")
 }
@@ -0,0 +1,192 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSelectSourceLabelSeeded checks that the weighted source selection is reproducible with a fixed seed.
+func TestSelectSourceLabelSeeded(t *testing.T) {
+	sources := []Source{
+		{Label: "source1", Weight: 1},
+		{Label: "source2", Weight: 2},
+		{Label: "source3", Weight: 3},
+		{Label: "source4", Weight: 4},
+	}
+	setSourceWeights(sources, nil)
+	defer setSourceWeights(nil, nil)
+
+	selections := func() []string {
+		rng := rand.New(rand.NewSource(1))
+		var labels []string
+		for i := 0; i < 50; i++ {
+			label, err := selectSourceLabel(rng, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			labels = append(labels, label)
+		}
+		return labels
+	}
+
+	first := selections()
+	for run := 0; run < 10; run++ {
+		for i, label := range selections() {
+			if label != first[i] {
+				t.Fatalf("selection %d is '%s'; want '%s' as in the first run", i, label, first[i])
+			}
+		}
+	}
+}
+
+// TestSelectSourceLabelZeroWeight checks that a source with a weight of 0 is never chosen, even once the other sources
+// are excluded.
+func TestSelectSourceLabelZeroWeight(t *testing.T) {
+	sources := []Source{{Label: "source1"}, {Label: "source2"}}
+	setSourceWeights(sources, map[string]float64{"source2": 0})
+	defer setSourceWeights(nil, nil)
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		label, err := selectSourceLabel(rng, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if label != "source1" {
+			t.Fatalf("selected '%s'; want 'source1'", label)
+		}
+	}
+
+	label, err := selectSourceLabel(rng, map[string]bool{"source1": true})
+	if err == nil {
+		t.Errorf("selected '%s' with only a zero weight source remaining; want an error", label)
+	}
+}
+
+// compressedTestFile compresses the domains with the command into a temp file named with the extension.
+// The test is skipped if the command isn't installed.
+func compressedTestFile(t *testing.T, command, extension, domains string) *os.File {
+	if _, err := exec.LookPath(command); err != nil {
+		t.Skipf("%s not installed", command)
+	}
+
+	cmd := exec.Command(command, "-c")
+	cmd.Stdin = strings.NewReader(domains)
+	compressed, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "*-domains.csv"+extension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Write(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+// checkDecompressed checks that the file was decompressed to the domains with the csv extension kept,
+// and that the compressed file was removed.
+func checkDecompressed(t *testing.T, compressed, decompressed *os.File, domains string) {
+	defer os.Remove(decompressed.Name())
+
+	if filepath.Ext(decompressed.Name()) != ".csv" {
+		t.Errorf("decompressed file '%s' lost its .csv extension", decompressed.Name())
+	}
+	data, err := ioutil.ReadFile(decompressed.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != domains {
+		t.Errorf("decompressed to %q; want %q", data, domains)
+	}
+	if _, err := os.Stat(compressed.Name()); !os.IsNotExist(err) {
+		t.Errorf("compressed file '%s' was not removed", compressed.Name())
+	}
+}
+
+// TestXzFile checks that an xz source is decompressed.
+func TestXzFile(t *testing.T) {
+	domains := "1,example.com\n2,example.org\n"
+	compressed := compressedTestFile(t, "xz", ".xz", domains)
+	defer os.Remove(compressed.Name())
+
+	decompressed, err := xzFile(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecompressed(t, compressed, decompressed, domains)
+}
+
+// TestZstdFile checks that a zstd source is decompressed, and that a corrupt one is reported as an error.
+func TestZstdFile(t *testing.T) {
+	domains := "1,example.com\n2,example.org\n"
+	compressed := compressedTestFile(t, "zstd", ".zst", domains)
+	defer os.Remove(compressed.Name())
+
+	decompressed, err := zstdFile(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecompressed(t, compressed, decompressed, domains)
+
+	corrupt, err := ioutil.TempFile("", "*-domains.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(corrupt.Name())
+	corrupt.WriteString(domains)
+	corrupt.Close()
+	_, err = zstdFile(corrupt)
+	if err == nil {
+		t.Error("decompressed a corrupt zstd file without an error")
+	}
+}
+
+// TestGunzipFileCleanup checks that a truncated gzip source is reported as an error, with both the downloaded file and
+// the partial output removed.
+func TestGunzipFileCleanup(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(strings.Repeat("1,example.com\n", 1000)))
+	w.Close()
+
+	f, err := ioutil.TempFile("", "*-domains.csv.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(buf.Bytes()[:buf.Len()/2])
+	f.Close()
+
+	_, err = gunzipFile(f)
+	if err == nil {
+		t.Fatal("gunzipped a truncated file without an error")
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("downloaded file '%s' was not removed", f.Name())
+	}
+	partial, _ := filepath.Glob(filepath.Join(os.TempDir(), "*-"+strings.TrimSuffix(filepath.Base(f.Name()), ".gz")))
+	if len(partial) > 0 {
+		t.Errorf("partial output %v was not removed", partial)
+		for _, p := range partial {
+			os.Remove(p)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// noiseProfiles contains the named noise profiles of the configuration and noiseSources the sources they weight.
+// noiseProfile is the name of the active profile, which overrides the noise periods, source weights, and schedule of the
+// configuration; an empty name (or no profiles at all) leaves the configuration as is.
+// The active profile may be switched at runtime, so it is guarded by noiseProfileMutex.
+var noiseProfiles map[string]NoiseProfile
+var noiseSources []Source
+var noiseProfile string
+var noiseProfileMutex sync.RWMutex
+
+// noiseProfilesConfig sets up the noise profiles and activates the selected one (if any).
+// The selection on the command line takes precedence over the one in the configuration.
+// A control endpoint for switching the profile at runtime is added to the metrics endpoint (if enabled).
+func noiseProfilesConfig(c *Config, selected string) {
+	noiseProfiles = c.Profiles
+	noiseSources = c.Sources
+	if len(noiseProfiles) == 0 {
+		return
+	}
+
+	if selected == "" {
+		selected = c.Profile
+	}
+	err := noiseProfileSwitch(selected)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	http.HandleFunc("/profile", noiseProfileHandler)
+}
+
+// noiseProfileSwitch activates the named noise profile, or the configuration as is if the name is empty.
+// The source weights are reset to those of the profile; sources the profile doesn't weight have a weight of 1.
+// It returns an error if there is no profile with the name.
+func noiseProfileSwitch(name string) error {
+	p, ok := noiseProfiles[name]
+	if name != "" && !ok {
+		return fmt.Errorf("Unknown noise profile '%s'", name)
+	}
+
+	noiseProfileMutex.Lock()
+	noiseProfile = name
+	noiseProfileMutex.Unlock()
+
+	setSourceWeights(noiseSources, p.SourceWeights)
+
+	if name == "" {
+		log.Println("Using the noise configuration without a profile")
+	} else {
+		log.Printf("Using noise profile '%s'", name)
+	}
+
+	return nil
+}
+
+// noiseProfilePeriods returns the min and max period of the active noise profile, or those of the noise configuration
+// if there is no active profile or it doesn't set them.
+func noiseProfilePeriods(n *Noise) (time.Duration, time.Duration) {
+	min, max := n.MinPeriod.Duration(), n.MaxPeriod.Duration()
+
+	noiseProfileMutex.RLock()
+	defer noiseProfileMutex.RUnlock()
+
+	p := noiseProfiles[noiseProfile]
+	if p.MinPeriod > 0 {
+		min = p.MinPeriod.Duration()
+	}
+	if p.MaxPeriod > 0 {
+		max = p.MaxPeriod.Duration()
+	}
+
+	return min, max
+}
+
+// noiseProfileSchedule returns the schedule of the active noise profile, or the schedule of the configuration
+// if there is no active profile or it doesn't have a schedule.
+func noiseProfileSchedule(s *Schedule) *Schedule {
+	noiseProfileMutex.RLock()
+	defer noiseProfileMutex.RUnlock()
+
+	if p := noiseProfiles[noiseProfile]; p.Schedule != nil {
+		return p.Schedule
+	}
+
+	return s
+}
+
+// noiseProfileHandler serves the control endpoint for the noise profile.
+// A GET returns the name of the active profile and a POST switches to the profile named in the request body
+// (an empty body switches back to the configuration without a profile).
+func noiseProfileHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		noiseProfileMutex.RLock()
+		name := noiseProfile
+		noiseProfileMutex.RUnlock()
+
+		fmt.Fprintln(w, name)
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = noiseProfileSwitch(strings.TrimSpace(string(body)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,152 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 hash of an empty request body, as sent with the S3 GET requests.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// objectStoreURL translates an object store URL ("s3://bucket/key" or "gs://bucket/object") into the https URL of the
+// object, along with the name of its store ("s3" or "gs"). Any other URL is returned as is with an empty store name.
+// S3 objects are fetched from the regional endpoint of the bucket, with the region taken from the environment
+// (AWS_REGION or AWS_DEFAULT_REGION, defaulting to "us-east-1").
+// It returns an error if the object store URL has no bucket or object.
+func objectStoreURL(sourceURL string) (string, string, error) {
+	var store string
+	switch {
+	case strings.HasPrefix(sourceURL, "s3://"):
+		store = "s3"
+	case strings.HasPrefix(sourceURL, "gs://"):
+		store = "gs"
+	default:
+		return sourceURL, "", nil
+	}
+
+	bucket, object := splitObjectPath(strings.TrimPrefix(sourceURL, store+"://"))
+	if bucket == "" || object == "" {
+		return "", "", fmt.Errorf("Object store URL '%s' must name a bucket and an object", sourceURL)
+	}
+
+	if store == "gs" {
+		return "https://storage.googleapis.com/" + bucket + "/" + object, store, nil
+	}
+
+	return "https://" + bucket + ".s3." + s3Region() + ".amazonaws.com/" + object, store, nil
+}
+
+// splitObjectPath splits the path of an object store URL into its bucket and object.
+func splitObjectPath(path string) (string, string) {
+	i := strings.Index(path, "/")
+	if i < 0 {
+		return path, ""
+	}
+
+	return path[:i], path[i+1:]
+}
+
+// s3Region returns the AWS region from the environment, or "us-east-1" if unset.
+func s3Region() string {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region
+		}
+	}
+
+	return "us-east-1"
+}
+
+// objectStoreAuth adds the credentials from the environment to the request for an object in the store.
+// S3 requests are signed (AWS Signature Version 4) with AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY (and AWS_SESSION_TOKEN
+// for temporary credentials). GCS requests carry GOOGLE_OAUTH_ACCESS_TOKEN as a bearer token, unless the source's headers
+// already set the authorization. Without credentials, the request is left unauthenticated (e.g. for a public bucket).
+func objectStoreAuth(r *http.Request, store string) {
+	switch store {
+	case "s3":
+		accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if accessKey != "" && secretKey != "" {
+			s3SignRequest(r, accessKey, secretKey, os.Getenv("AWS_SESSION_TOKEN"), s3Region(), time.Now())
+		}
+	case "gs":
+		if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+}
+
+// s3SignRequest signs the bodiless S3 request with AWS Signature Version 4 as of the given time.
+// The host and all of the request's other headers (e.g. any set by the source's headers) are signed.
+func s3SignRequest(r *http.Request, accessKey, secretKey, sessionToken, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if sessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	// the canonical headers are lowercased and sorted by name, with the host included (and any authorization replaced)
+	headers := map[string]string{"host": r.URL.Host}
+	for name, values := range r.Header {
+		if name = strings.ToLower(name); name != "authorization" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.ReplaceAll(r.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data with the key.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sha256Hex returns the hex-encoded SHA-256 hash of the data.
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
@@ -5,10 +5,17 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
 	"strings"
 	"time"
 )
@@ -20,18 +27,41 @@ type PiholeQueries struct {
 	Data [][]string
 }
 
+// piholeClient is the HTTP client used for accessing the pihole's admin API.
+var piholeClient = http.DefaultClient
+
+// piholeClientConfig sets up the HTTP client used for accessing the pihole's admin API.
+// If insecure verification is configured, the pihole's certificate is not verified when using https.
+// This is intended only for a reverse proxy with a self-signed certificate or internal CA.
+func piholeClientConfig(p *Pihole) {
+	if !p.Insecure {
+		return
+	}
+
+	log.Println("WARNING: TLS certificate verification disabled for pihole")
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	piholeClient = &http.Client{Transport: transport}
+}
+
 // piholeFetchActivity polls the configured pihole for query activity.
 // It accepts the pihole configuration information block and returns the number of queries observed.
-// On error, it returns a value of 0.
+// On error, it returns a value of 0. The error never includes the request URL, as it carries the auth token.
 func piholeFetchActivity(p *Pihole) (int, error) {
 	until := time.Now().Unix()
 	from := until - int64(p.ActivityPeriod.Duration().Seconds())
 
 	// Time values need to be expressed in Unix epoch time format
-	url := fmt.Sprintf("http://%s/admin/api.php?getAllQueries&from=%d&until=%d&auth=%s", p.Host, from, until, p.AuthToken)
+	// The base path is configurable to support a pihole fronted by a reverse proxy
+	endpoint := path.Join("/", p.BasePath, "api.php")
+	requestURL := fmt.Sprintf("%s://%s%s?getAllQueries&from=%d&until=%d&auth=%s", p.Scheme, p.Host, endpoint, from, until, p.AuthToken)
 
-	response, err := http.Get(url)
+	response, err := piholeClient.Get(requestURL)
 	if err != nil {
+		// the client's error quotes the full URL, so only its cause is kept to avoid logging the auth token
+		if urlErr, ok := err.(*url.Error); ok {
+			err = fmt.Errorf("Unable to fetch activity from '%s': %v", p.Host, urlErr.Err)
+		}
 		return 0, err
 	}
 	defer response.Body.Close()
@@ -51,8 +81,11 @@ func piholeFetchActivity(p *Pihole) (int, error) {
 		return 0, err
 	}
 
+	// the real traffic activates the cover sets of any sensitive domains queried
+	coverObserve(queries.Data, p.Columns.Domain)
+
 	// Filters out entries from dns-noise host (if applicable)
-	numQueries := piholeFilterNoise(p.Filter, queries.Data)
+	numQueries := piholeFilterNoise(p.Filter, p.Columns.Client, queries.Data)
 	if numQueries <= 0 {
 		return 0, fmt.Errorf("No activity available from pihole")
 	}
@@ -62,22 +95,46 @@ func piholeFetchActivity(p *Pihole) (int, error) {
 
 // piholeFilterNoise removes the queries from the filtered host from the query activity total.
 // If the filter string is empty, then it simply returns the number of queries in the set.
+// The client is read from the given column; a query without that column can't be filtered and is counted (and logged),
+// since it most likely means the pihole's layout has changed and the filter has silently stopped working.
 // It returns the adjusted total number of queries in the set.
-func piholeFilterNoise(filter string, queries [][]string) int {
+func piholeFilterNoise(filter string, client int, queries [][]string) int {
 	if filter == "" {
 		return len(queries)
 	}
 
-	var numQueries int
+	var numQueries, short int
 	for _, query := range queries {
-		if !strings.HasPrefix(query[3], filter) {
+		if len(query) <= client {
+			short++
+			numQueries++
+		} else if !piholeClientMatches(filter, query[client]) {
 			numQueries++
 		}
 	}
+	if short > 0 {
+		log.Printf("WARNING: %d pihole queries without a client in column %d; check the pihole columns", short, client)
+	}
 
 	return numQueries
 }
 
+// piholeClientMatches checks whether the client field of a pihole query matches the filter.
+// The pihole reports the client by hostname if it can resolve one, otherwise by IP address.
+// A filter in CIDR form (e.g. "192.168.1.0/24") matches a client IP address within the network, a filter that is an
+// IP address matches that client IP address, and any other filter matches a client hostname by prefix.
+func piholeClientMatches(filter, client string) bool {
+	if _, network, err := net.ParseCIDR(filter); err == nil {
+		ip := net.ParseIP(client)
+		return ip != nil && network.Contains(ip)
+	}
+	if filterIP := net.ParseIP(filter); filterIP != nil {
+		return filterIP.Equal(net.ParseIP(client))
+	}
+
+	return strings.HasPrefix(client, filter)
+}
+
 // piholeEnabled checks the necessary settings are present in the config for pihole utilization.
 // It does not perform any validation checks on the setting values.
 // It returns a bool reflecting the configuration is setup or not.
@@ -96,3 +153,27 @@ func piholeEnabled(p *Pihole) bool {
 
 	return enabled
 }
+
+// piholeReadToken reads the pihole auth token from the pihole's setupVars.conf file (e.g. "/etc/pihole/setupVars.conf").
+// The token is the value of the "WEBPASSWORD" option.
+// It returns the token, or an error if the file cannot be read or does not contain the option.
+func piholeReadToken(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "WEBPASSWORD=") {
+			return strings.Trim(strings.TrimPrefix(line, "WEBPASSWORD="), `"'`), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("No WEBPASSWORD found in '%s'", path)
+}
@@ -0,0 +1,147 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+/*
+Profile contains the empirical distributions of a captured traffic profile, used in place of the synthetic ones.
+It is loaded from the JSON file named by the "profileFile" noise element, e.g.
+
+	{
+	  "intervals": [
+	    { "max": "100ms", "weight": 120 },
+	    { "max": "1s", "weight": 300 },
+	    { "max": "10s", "weight": 80 }
+	  ],
+	  "types": { "A": 70, "AAAA": 25, "MX": 5 }
+	}
+
+The "intervals" are a histogram of the time between queries. Each bucket covers the interval from the previous
+bucket's max (or 0) up to its own max, and a bucket is chosen with a probability proportional to its weight.
+The "types" are the relative weights of the query types. Either may be omitted to keep the synthetic distribution.
+*/
+type Profile struct {
+	Intervals []ProfileBucket `json:"intervals"`
+	Types     map[string]int  `json:"types"`
+	typeNames []string
+}
+
+type ProfileBucket struct {
+	Max    Duration `json:"max"`
+	Weight int      `json:"weight"`
+}
+
+// trafficProfile contains the loaded traffic profile. If nil, the synthetic distributions are used.
+var trafficProfile *Profile
+
+// profileConfig loads the traffic profile named in the noise configuration (if any).
+// It is a fatal error if the profile cannot be loaded.
+func profileConfig(n *Noise) {
+	if n.ProfileFile == "" {
+		return
+	}
+
+	p, err := loadProfile(n.ProfileFile, n.AllowAny)
+	if err != nil {
+		log.Fatalf("Unable to load traffic profile '%s': %v", n.ProfileFile, err)
+	}
+
+	log.Printf("Loaded traffic profile '%s' (%d interval buckets, %d query types)", n.ProfileFile, len(p.Intervals), len(p.Types))
+	trafficProfile = p
+}
+
+// loadProfile reads and checks the traffic profile in the file.
+// The interval buckets are sorted by their max, and the weights must not be negative.
+// The "ANY" query type is only accepted if allowAny is set.
+// If the profile cannot be read or is invalid, it returns the error encountered.
+func loadProfile(path string, allowAny bool) (*Profile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := new(Profile)
+	err = json.Unmarshal(data, p)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(p.Intervals, func(i, j int) bool { return p.Intervals[i].Max < p.Intervals[j].Max })
+	for _, b := range p.Intervals {
+		if b.Max <= 0 || b.Weight < 0 {
+			return nil, fmt.Errorf("Invalid interval bucket (max %v, weight %d)", b.Max.Duration(), b.Weight)
+		}
+	}
+
+	for t, w := range p.Types {
+		if !dnsSupportedType(t, allowAny) {
+			return nil, fmt.Errorf("Unsupported query type '%s'", t)
+		}
+		if w < 0 {
+			return nil, fmt.Errorf("Negative weight for query type '%s'", t)
+		}
+		p.typeNames = append(p.typeNames, t)
+	}
+	// the map order is random, so fix the order to keep the sampling reproducible with a deterministic seed
+	sort.Strings(p.typeNames)
+
+	return p, nil
+}
+
+// sampleInterval returns an interval between queries sampled from the interval histogram.
+// A bucket is chosen by weight and the interval is uniformly distributed within the bucket.
+// It returns false if there are no intervals (or all have a weight of 0).
+func (p *Profile) sampleInterval(rng *rand.Rand) (time.Duration, bool) {
+	var total int
+	for _, b := range p.Intervals {
+		total += b.Weight
+	}
+	if total <= 0 {
+		return 0, false
+	}
+
+	pick := rng.Intn(total)
+	var min time.Duration
+	for _, b := range p.Intervals {
+		if pick < b.Weight {
+			return min + time.Duration(rng.Int63n(int64(b.Max.Duration()-min)+1)), true
+		}
+		pick -= b.Weight
+		min = b.Max.Duration()
+	}
+
+	return 0, false
+}
+
+// sampleType returns a query type sampled from the query type weights.
+// It returns an empty string if there are no types (or all have a weight of 0).
+func (p *Profile) sampleType(rng *rand.Rand) string {
+	var total int
+	for _, t := range p.typeNames {
+		total += p.Types[t]
+	}
+	if total <= 0 {
+		return ""
+	}
+
+	pick := rng.Intn(total)
+	for _, t := range p.typeNames {
+		if pick < p.Types[t] {
+			return t
+		}
+		pick -= p.Types[t]
+	}
+
+	return ""
+}
@@ -6,42 +6,191 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 var (
-	dnsReqVec = promauto.NewCounterVec(prometheus.CounterOpts{
+	dnsReqVec = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "dns_noise_request",
 		Help: "The total number of DNS requests issued."},
 		[]string{"type", "server", "rcode"})
 
-	dnsRespVec = promauto.NewCounterVec(prometheus.CounterOpts{
+	dnsRespVec = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "dns_noise_response",
-		Help: "The total number of DNS records received."},
+		Help: "The total number of DNS records received (NODATA responses are counted with an rcode of NODATA)."},
 		[]string{"type", "server", "rcode"})
 
-	dnsRespTimeVec = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	dnsRespTimeVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "dns_noise_responsetime",
 		Help:    "The response times for DNS queries.",
 		Buckets: prometheus.LinearBuckets(50, 50, 15)},
 		[]string{"type", "server"})
 
+	dnsRespBytesVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dns_noise_response_bytes",
+		Help:    "The sizes (in bytes) of the DNS response messages.",
+		Buckets: prometheus.ExponentialBuckets(64, 2, 8)},
+		[]string{"type"})
+
 	// note: not a vector!
-	dnsPiholeRate = promauto.NewGauge(prometheus.GaugeOpts{
+	dnsPiholeRate = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "dns_noise_pihole_qps",
-		Help: "Pihole query rate (adjusted after filtering).",
+		Help: "Live query rate from the pihole or the activity source (adjusted after filtering).",
+	})
+
+	dnsPiholeCorrection = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dns_noise_pihole_correction",
+		Help: "The estimated number of noise queries subtracted from the live activity at the last refresh.",
+	})
+
+	dnsSleepPeriod = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dns_noise_sleep_period_seconds",
+		Help: "The most recent sleep period between noise queries.",
+	})
+
+	dnsLiveRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dns_noise_live_ratio",
+		Help: "The ratio of the noise query rate to the live query rate (adjusted after filtering) over the last refresh.",
 	})
 
-	dnsNoiseDomains = promauto.NewGauge(prometheus.GaugeOpts{
+	dnsNoiseDomains = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "dns_noise_domains",
 		Help: "The total number of noise domains available.",
 	})
+
+	dnsNoiseDomainsExceeded = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dns_noise_domains_exceeded",
+		Help: "Whether the number of noise domains exceeds the expected maximum (1) or not (0).",
+	})
+
+	metricsListening = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dns_noise_metrics_listening",
+		Help: "Whether the metrics endpoint is listening for scrapes (1) or not (0).",
+	})
+
+	dnsCnameFollow = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_noise_cname_follow_total",
+		Help: "The total number of follow-up queries issued for the targets of CNAME answers.",
+	})
+
+	dnsTransportErrorVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_noise_transport_errors_total",
+		Help: "The total number of DNS queries which failed without a response (e.g. a connection error or timeout)."},
+		[]string{"server"})
+
+	dnsSlowQueryVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_noise_slow_queries_total",
+		Help: "The total number of DNS queries with a response time exceeding the slowQuery threshold."},
+		[]string{"server"})
+
+	dnsTruncatedRetry = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_noise_truncated_retry_total",
+		Help: "The total number of truncated UDP responses retried over TCP.",
+	})
+
+	dnsDnssecAdVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_noise_dnssec_ad_total",
+		Help: "The total number of successful DNS responses marked as authenticated (AD bit set) by the resolver."},
+		[]string{"type", "server"})
+
+	dnsRecursionUnavailableVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_noise_recursion_unavailable_total",
+		Help: "The total number of DNS responses to recursive queries without recursion available (RA bit clear)."},
+		[]string{"server"})
+
+	dnsTldVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_noise_tld",
+		Help: "The total number of noise domains selected by top-level domain."},
+		[]string{"tld"})
+
+	dnsQueriesBySourceVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_noise_queries_by_source",
+		Help: "The total number of noise domains queried by the label of their source."},
+		[]string{"label"})
+
+	dnsNameserverUpVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_noise_nameserver_up",
+		Help: "Whether the most recent query to the nameserver succeeded (1) or failed (0)."},
+		[]string{"server"})
+
+	dnsConsecutiveFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dns_noise_consecutive_failures",
+		Help: "The number of consecutive queries for which every nameserver failed (reset on any successful query).",
+	})
+
+	dnsNameservers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dns_noise_nameservers",
+		Help: "The total number of nameservers configured.",
+	})
+
+	sourceFetchVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_noise_source_fetch_total",
+		Help: "The total number of domains source fetches by HTTP status."},
+		[]string{"label", "status"})
+
+	sourceUnchangedVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_noise_source_unchanged_total",
+		Help: "The total number of domains source refreshes skipped as the data was unchanged."},
+		[]string{"label"})
+
+	domainsSkippedVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_noise_domains_skipped_total",
+		Help: "The total number of domains skipped while loading a source by reason."},
+		[]string{"reason", "label"})
 )
 
+// metricsCollectors contains all of the metrics, which are registered once the configuration is loaded (see metricsRegister).
+var metricsCollectors = []prometheus.Collector{
+	dnsReqVec,
+	dnsRespVec,
+	dnsRespTimeVec,
+	dnsRespBytesVec,
+	dnsPiholeRate,
+	dnsPiholeCorrection,
+	dnsSleepPeriod,
+	dnsLiveRatio,
+	dnsNoiseDomains,
+	dnsNoiseDomainsExceeded,
+	metricsListening,
+	dnsCnameFollow,
+	dnsTransportErrorVec,
+	dnsSlowQueryVec,
+	dnsTruncatedRetry,
+	dnsDnssecAdVec,
+	dnsRecursionUnavailableVec,
+	dnsTldVec,
+	dnsQueriesBySourceVec,
+	dnsNameserverUpVec,
+	dnsConsecutiveFailures,
+	dnsNameservers,
+	sourceFetchVec,
+	sourceUnchangedVec,
+	domainsSkippedVec,
+}
+
+// metricsRegister registers all of the metrics with the default registry.
+// The constant labels (if any) are applied to every metric, which distinguishes the metrics of multiple instances
+// scraped into the same Prometheus. It is a fatal error if the metrics cannot be registered (e.g. an invalid label name).
+func metricsRegister(labels map[string]string) {
+	var registerer prometheus.Registerer = prometheus.DefaultRegisterer
+	if len(labels) > 0 {
+		registerer = prometheus.WrapRegistererWith(labels, registerer)
+	}
+
+	for _, c := range metricsCollectors {
+		err := registerer.Register(c)
+		if err != nil {
+			log.Fatalf("Unable to register metrics: %v", err)
+		}
+	}
+}
+
 func metricsDnsReq(label, server, rcode string) {
 	dnsReqVec.WithLabelValues(label, server, rcode).Inc()
 }
@@ -50,33 +199,206 @@ func metricsDnsResp(label, server, rcode string) {
 	dnsRespVec.WithLabelValues(label, server, rcode).Inc()
 }
 
+func metricsDnsRespAdd(label, server, rcode string, num int) {
+	dnsRespVec.WithLabelValues(label, server, rcode).Add(float64(num))
+}
+
 func metricsDnsRespTime(dur float64, label, server string) {
 	dnsRespTimeVec.WithLabelValues(label, server).Observe(dur)
 }
 
+func metricsDnsRespBytes(size float64, label string) {
+	dnsRespBytesVec.WithLabelValues(label).Observe(size)
+}
+
 func metricsDnsPiholeRate(rate float64) {
 	dnsPiholeRate.Set(rate)
 }
 
+func metricsDnsPiholeCorrection(num float64) {
+	dnsPiholeCorrection.Set(num)
+}
+
+func metricsDnsSleepPeriod(period time.Duration) {
+	dnsSleepPeriod.Set(period.Seconds())
+}
+
+func metricsDnsLiveRatio(ratio float64) {
+	dnsLiveRatio.Set(ratio)
+}
+
 func metricsDnsNoiseDomains(num float64) {
 	dnsNoiseDomains.Set(num)
 }
 
+func metricsDnsNoiseDomainsExceeded(exceeded bool) {
+	if exceeded {
+		dnsNoiseDomainsExceeded.Set(1)
+	} else {
+		dnsNoiseDomainsExceeded.Set(0)
+	}
+}
+
+func metricsDnsCnameFollow() {
+	dnsCnameFollow.Inc()
+}
+
+func metricsDnsTransportError(server string) {
+	dnsTransportErrorVec.WithLabelValues(server).Inc()
+}
+
+func metricsDnsSlowQuery(server string) {
+	dnsSlowQueryVec.WithLabelValues(server).Inc()
+}
+
+func metricsDnsTruncatedRetry() {
+	dnsTruncatedRetry.Inc()
+}
+
+func metricsDnsDnssecAd(label, server string) {
+	dnsDnssecAdVec.WithLabelValues(label, server).Inc()
+}
+
+func metricsDnsRecursionUnavailable(server string) {
+	dnsRecursionUnavailableVec.WithLabelValues(server).Inc()
+}
+
+func metricsDnsTld(tld string) {
+	dnsTldVec.WithLabelValues(tld).Inc()
+}
+
+func metricsDnsQueriesBySource(label string) {
+	dnsQueriesBySourceVec.WithLabelValues(label).Inc()
+}
+
+func metricsDnsNameserverUp(server string, up bool) {
+	if up {
+		dnsNameserverUpVec.WithLabelValues(server).Set(1)
+	} else {
+		dnsNameserverUpVec.WithLabelValues(server).Set(0)
+	}
+}
+
+func metricsDnsConsecutiveFailures(num float64) {
+	dnsConsecutiveFailures.Set(num)
+}
+
+func metricsDnsNameservers(num float64) {
+	dnsNameservers.Set(num)
+}
+
+func metricsSourceFetch(label, status string) {
+	sourceFetchVec.WithLabelValues(label, status).Inc()
+}
+
+func metricsSourceUnchanged(label string) {
+	sourceUnchangedVec.WithLabelValues(label).Inc()
+}
+
+func metricsDomainsSkipped(reason, label string) {
+	domainsSkippedVec.WithLabelValues(reason, label).Inc()
+}
+
+func metricsDomainsSkippedAdd(reason, label string, num int) {
+	domainsSkippedVec.WithLabelValues(reason, label).Add(float64(num))
+}
+
 func metricsConfig(conf *Metrics) {
 	if conf == nil {
 		log.Println("Metrics not configured; omitting")
 		return
 	}
 
+	// the metrics are still registered when not scraped as they may be pushed
+	metricsRegister(conf.Labels)
+
+	// periodic pushes are independent of the scrape endpoint
+	if conf.PushGateway != "" && conf.PushInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(conf.PushInterval.Duration())
+			defer ticker.Stop()
+			for range ticker.C {
+				metricsPush(conf)
+			}
+		}()
+	}
+
 	if conf.Enabled == false {
 		log.Println("Metrics disabled; omitting")
 		return
 	}
 
-	http.Handle(conf.Path, promhttp.Handler())
-	port := ":" + strconv.Itoa(conf.Port)
+	http.Handle(conf.Path, metricsHandler(conf))
+
+	// the metrics are best-effort, so a port that can't be bound never stops the noise queries
+	listener, err := metricsListen(conf.Port, conf.PortRetries)
+	if err != nil {
+		log.Printf("Unable to listen for metrics scrapes; metrics endpoint disabled: %v", err)
+		return
+	}
+	metricsListening.Set(1)
 
 	go func() {
-		http.ListenAndServe(port, nil)
+		err := http.Serve(listener, nil)
+		metricsListening.Set(0)
+		log.Printf("Metrics endpoint stopped: %v", err)
 	}()
 }
+
+// metricsHandler creates the handler for the metrics scrapes with the handler options of the metrics configuration.
+// As with promhttp.Handler(), the default registry is served and the scrapes themselves are instrumented.
+func metricsHandler(conf *Metrics) http.Handler {
+	opts := promhttp.HandlerOpts{
+		ErrorLog:            metricsErrorLog{},
+		MaxRequestsInFlight: conf.MaxRequestsInFlight,
+		Timeout:             conf.Timeout.Duration(),
+	}
+	switch conf.ErrorHandling {
+	case "continue":
+		opts.ErrorHandling = promhttp.ContinueOnError
+	case "panic":
+		opts.ErrorHandling = promhttp.PanicOnError
+	default:
+		opts.ErrorHandling = promhttp.HTTPErrorOnError
+	}
+
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, opts))
+}
+
+// metricsErrorLog logs the errors encountered while serving the metrics scrapes.
+type metricsErrorLog struct{}
+
+// Println logs the error with the standard logger, satisfying promhttp.Logger.
+func (metricsErrorLog) Println(v ...interface{}) {
+	log.Println(v...)
+}
+
+// metricsListen opens a listener on the port, trying up to the number of retries of the subsequent ports if it is in use.
+// It returns the listener for the first port that could be bound, or the last error encountered.
+func metricsListen(port, retries int) (net.Listener, error) {
+	var err error
+	for i := 0; i <= retries; i++ {
+		var listener net.Listener
+		listener, err = net.Listen("tcp", ":"+strconv.Itoa(port+i))
+		if err == nil {
+			log.Printf("Metrics listening on port %d", port+i)
+			return listener, nil
+		}
+		log.Print(err)
+	}
+
+	return nil, err
+}
+
+// metricsPush pushes the collected metrics to the configured Prometheus Pushgateway (if any).
+// A failed push is logged but is not fatal.
+func metricsPush(conf *Metrics) {
+	if conf == nil || conf.PushGateway == "" {
+		return
+	}
+
+	err := push.New(conf.PushGateway, conf.PushJob).Gatherer(prometheus.DefaultGatherer).Push()
+	if err != nil {
+		log.Printf("Unable to push metrics to '%s': %v", conf.PushGateway, err)
+	}
+}
@@ -0,0 +1,60 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"time"
+)
+
+// statusInterval is how often the status line is updated.
+const statusInterval = time.Second
+
+// statusLine renders a compact status line to stderr, updated in place every statusInterval, for watching the behavior
+// in a terminal without setting up Prometheus. The values are read from the same metrics that are scraped.
+// Any log output written to stderr will interrupt the line until its next update.
+// It runs until the application exits and is intended to be run as a goroutine.
+func statusLine() {
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	var lastRequests float64
+	for range ticker.C {
+		values := statusValues()
+		requests := values["dns_noise_request"]
+		rate := (requests - lastRequests) / statusInterval.Seconds()
+		lastRequests = requests
+
+		sleep := time.Duration(values["dns_noise_sleep_period_seconds"] * float64(time.Second)).Round(time.Millisecond)
+		fmt.Fprintf(os.Stderr, "\r%.2f queries/s | sleep %v | %.0f domains | live %.2f queries/s\033[K",
+			rate, sleep, values["dns_noise_domains"], values["dns_noise_pihole_qps"])
+	}
+}
+
+// statusValues gathers the current value of each of the counter and gauge metrics, summed across their labels.
+// It returns the values by metric name; if the metrics cannot be gathered, the values are empty.
+func statusValues() map[string]float64 {
+	values := make(map[string]float64)
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return values
+	}
+
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			if m.GetCounter() != nil {
+				values[mf.GetName()] += m.GetCounter().GetValue()
+			}
+			if m.GetGauge() != nil {
+				values[mf.GetName()] += m.GetGauge().GetValue()
+			}
+		}
+	}
+
+	return values
+}
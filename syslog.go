@@ -0,0 +1,18 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// syslogWriter returns a writer that sends the log output to the system log.
+func syslogWriter() (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "dns-noise")
+}
@@ -0,0 +1,18 @@
+//
+// Copyright 2020 Steven T Black
+//
+
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// syslogWriter is not supported on platforms without a system log.
+func syslogWriter() (io.Writer, error) {
+	return nil, fmt.Errorf("syslog is not supported on this platform")
+}